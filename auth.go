@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	authNone    = "none"
+	authBasic   = "basic"
+	authBearer  = "bearer"
+	authIdToken = "idtoken"
+)
+
+// authenticator adds credentials to a request before it is sent to a downstream service
+type authenticator interface {
+	authenticate(req *http.Request) error
+}
+
+type noAuth struct{}
+
+func (noAuth) authenticate(req *http.Request) error {
+	return nil
+}
+
+type basicAuth struct {
+	credentials *Credentials
+}
+
+func (a basicAuth) authenticate(req *http.Request) error {
+	username, password := a.credentials.get()
+	req.SetBasicAuth(username, password)
+	return nil
+}
+
+// tokenAuth sets a bearer token from a token source, used for both static bearer tokens and
+// Google-signed ID tokens for services behind IAP or Cloud Run
+type tokenAuth struct {
+	source oauth2.TokenSource
+}
+
+func (a tokenAuth) authenticate(req *http.Request) error {
+	token, err := a.source.Token()
+	if err != nil {
+		return fmt.Errorf("unable to get token: %w", err)
+	}
+	token.SetAuthHeader(req)
+	return nil
+}
+
+// fileTokenSource re-reads the token on every request so that a token rotated on disk is used
+// straight away
+type fileTokenSource struct {
+	path string
+}
+
+func (s fileTokenSource) Token() (*oauth2.Token, error) {
+	token, err := readSecretFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, errors.New("bearer token file is empty")
+	}
+	return &oauth2.Token{AccessToken: token, TokenType: "Bearer"}, nil
+}
+
+func newAuthenticator(ctx context.Context, config DownstreamConfig, credentials *Credentials) (authenticator, error) {
+	switch config.Auth {
+	case authNone, "":
+		return noAuth{}, nil
+	case authBasic:
+		return basicAuth{credentials: credentials}, nil
+	case authBearer:
+		if config.BearerTokenFile != "" {
+			return tokenAuth{source: fileTokenSource{path: config.BearerTokenFile}}, nil
+		}
+		return tokenAuth{source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: config.BearerToken, TokenType: "Bearer"})}, nil
+	case authIdToken:
+		source, err := idtoken.NewTokenSource(ctx, config.audience())
+		if err != nil {
+			return nil, fmt.Errorf("unable to create id token source: %w", err)
+		}
+		return tokenAuth{source: source}, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication type %q", config.Auth)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestNoAuth(t *testing.T) {
+	assert := assert.New(t)
+	auth, err := newAuthenticator(context.Background(), DownstreamConfig{Auth: authNone}, nil)
+	assert.Nil(err)
+
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	assert.Nil(auth.authenticate(req))
+	assert.Empty(req.Header.Get("Authorization"))
+}
+
+func TestBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+	auth, err := newAuthenticator(context.Background(), DownstreamConfig{Auth: authBasic}, newStaticCredentials("admin", "secret"))
+	assert.Nil(err)
+
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	assert.Nil(auth.authenticate(req))
+	username, password, ok := req.BasicAuth()
+	assert.True(ok)
+	assert.Equal("admin", username)
+	assert.Equal("secret", password)
+}
+
+func TestBearerAuth(t *testing.T) {
+	assert := assert.New(t)
+	auth, err := newAuthenticator(context.Background(), DownstreamConfig{Auth: authBearer, BearerToken: "token"}, nil)
+	assert.Nil(err)
+
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	assert.Nil(auth.authenticate(req))
+	assert.Equal("Bearer token", req.Header.Get("Authorization"))
+}
+
+func TestBearerAuthFromFile(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "token")
+	assert.Nil(os.WriteFile(path, []byte("first\n"), 0600))
+
+	auth, err := newAuthenticator(context.Background(), DownstreamConfig{Auth: authBearer, BearerTokenFile: path}, nil)
+	assert.Nil(err)
+
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	assert.Nil(auth.authenticate(req))
+	assert.Equal("Bearer first", req.Header.Get("Authorization"))
+
+	// a rotated token is used on the next request
+	assert.Nil(os.WriteFile(path, []byte("second\n"), 0600))
+	req, _ = http.NewRequest("GET", "http://localhost", nil)
+	assert.Nil(auth.authenticate(req))
+	assert.Equal("Bearer second", req.Header.Get("Authorization"))
+}
+
+func TestBearerAuthMissingFile(t *testing.T) {
+	auth, err := newAuthenticator(context.Background(), DownstreamConfig{Auth: authBearer, BearerTokenFile: "/does/not/exist"}, nil)
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	assert.NotNil(t, auth.authenticate(req))
+}
+
+func TestTokenAuth(t *testing.T) {
+	// id tokens are set in the same way as any other token, so use a static source
+	auth := tokenAuth{source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "id-token"})}
+
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	assert.Nil(t, auth.authenticate(req))
+	assert.Equal(t, "Bearer id-token", req.Header.Get("Authorization"))
+}
+
+func TestUnknownAuth(t *testing.T) {
+	_, err := newAuthenticator(context.Background(), DownstreamConfig{Auth: "digest"}, nil)
+	assert.ErrorContains(t, err, "unknown authentication type")
+}
+
+func TestAudienceDefaultsToBaseUrl(t *testing.T) {
+	assert := assert.New(t)
+	config := DownstreamConfig{BaseURL: "https://sample.run.app"}
+	assert.Equal("https://sample.run.app", config.audience())
+	config.Audience = "client-id.apps.googleusercontent.com"
+	assert.Equal("client-id.apps.googleusercontent.com", config.audience())
+}
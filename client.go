@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// ServiceClient sends authenticated HTTP requests to a downstream service. It is created once at
+// startup so that connections are reused across messages, and so one rate limit is shared by them
+type ServiceClient struct {
+	config  DownstreamConfig
+	client  *http.Client
+	auth    authenticator
+	limiter *rate.Limiter
+}
+
+func newServiceClient(ctx context.Context, config DownstreamConfig, credentials *Credentials) (*ServiceClient, error) {
+	auth, err := newAuthenticator(ctx, config, credentials)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := config.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DisableKeepAlives:   false,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     config.IdleConnTimeout,
+		TLSClientConfig:     tlsConfig,
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+	}
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if config.RateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(config.RateLimit), config.RateBurst)
+	}
+	return &ServiceClient{config: config, client: client, auth: auth, limiter: limiter}, nil
+}
+
+// serviceClients are the clients created so far, by service and base url
+type serviceClients map[string]*ServiceClient
+
+// get returns the client for the service at the configured base url, creating it the first time
+func (s serviceClients) get(ctx context.Context, config DownstreamConfig, credentials *Credentials) (*ServiceClient, error) {
+	key := config.Name + " " + config.BaseURL
+	if client, ok := s[key]; ok {
+		return client, nil
+	}
+	client, err := newServiceClient(ctx, config, credentials)
+	if err != nil {
+		return nil, err
+	}
+	s[key] = client
+	return client, nil
+}
+
+func (sc *ServiceClient) baseUrl() string {
+	return sc.config.BaseURL
+}
+
+// omitEmpty is whether empty numbers and dates are left out of payloads rather than sent as null
+func (sc *ServiceClient) omitEmpty() bool {
+	return sc.config.EmptyFields == emptyFieldsOmit
+}
+
+func (sc *ServiceClient) do(req *http.Request) (*http.Response, error) {
+	if err := sc.wait(req.Context()); err != nil {
+		logger.Error("error waiting for rate limit", zap.Error(err), zap.String("service", sc.config.Name))
+		return nil, err
+	}
+	if err := sc.auth.authenticate(req); err != nil {
+		logger.Error("error authenticating HTTP request", zap.Error(err))
+		return nil, err
+	}
+	setTraceParent(req)
+	return sc.client.Do(req)
+}
+
+// wait blocks until the rate limit allows another request. Pub/Sub keeps extending the ack
+// deadline of the message meanwhile, up to PUBSUB_MAX_EXTENSION
+func (sc *ServiceClient) wait(ctx context.Context) error {
+	start := time.Now()
+	if err := sc.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		downstreamMetrics.Add(sc.config.Name+".rateLimitWaits", 1)
+		downstreamMetrics.AddFloat(sc.config.Name+".rateLimitWaitSeconds", waited.Seconds())
+		logger.Debug("rate limited request", zap.String("service", sc.config.Name), zap.Duration("waited", waited))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceClientAuthenticatesRequests(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Bearer token", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	config := testConfig().SampleService
+	config.BaseURL = ts.URL
+	config.Auth = authBearer
+	config.BearerToken = "token"
+	service, err := newServiceClient(context.Background(), config, nil)
+	assert.Nil(err)
+
+	req, _ := http.NewRequest("GET", service.baseUrl(), nil)
+	resp, err := service.do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestSampleServiceAuthenticated(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{\"id\":\"1111\"}"))
+	}))
+	defer ts.Close()
+
+	s := createSample()
+	s.service = testServiceClient(ts.URL)
+	id, err := s.getSampleUnitID(context.Background())
+	assert.Nil(err)
+	assert.Equal("1111", id)
+}
+
+func TestServiceClientUnknownAuth(t *testing.T) {
+	config := testConfig().SampleService
+	config.Auth = "digest"
+	_, err := newServiceClient(context.Background(), config, nil)
+	assert.NotNil(t, err)
+}
+
+func TestServiceClientRateLimited(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	config := testConfig().SampleService
+	config.Name = "limited"
+	config.BaseURL = ts.URL
+	config.RateLimit = 10
+	config.RateBurst = 1
+	service, err := newServiceClient(context.Background(), config, nil)
+	assert.Nil(err)
+
+	waits, waited := metric(downstreamMetrics, "limited.rateLimitWaits"), metric(downstreamMetrics, "limited.rateLimitWaitSeconds")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", service.baseUrl(), nil)
+		resp, err := service.do(req)
+		assert.Nil(err)
+		resp.Body.Close()
+	}
+	// the first request uses the burst and the other two wait 100ms each
+	assert.GreaterOrEqual(time.Since(start), 180*time.Millisecond)
+	assert.Equal(2.0, metric(downstreamMetrics, "limited.rateLimitWaits")-waits)
+	assert.Greater(metric(downstreamMetrics, "limited.rateLimitWaitSeconds")-waited, 0.15)
+}
+
+// metric is the value of a counter, or 0 before it's first counted. The counters are shared by
+// every test in the run, so tests compare the value before and after
+func metric(m *expvar.Map, key string) float64 {
+	v := m.Get(key)
+	if v == nil {
+		return 0
+	}
+	value, _ := strconv.ParseFloat(v.String(), 64)
+	return value
+}
+
+func TestServiceClientRateLimitCancelled(t *testing.T) {
+	config := testConfig().SampleService
+	config.RateLimit = 0.1
+	config.RateBurst = 1
+	service, err := newServiceClient(context.Background(), config, nil)
+	assert.Nil(t, err)
+	// use up the burst so the next request has to wait
+	assert.Nil(t, service.wait(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", service.baseUrl(), nil)
+	_, err = service.do(req)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/spf13/viper"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[REDACTED]"
+
+// Config is loaded once at startup and injected into the worker, rather than each
+// component reading viper as and when it needs a value
+type Config struct {
+	ProjectID       string
+	SubscriptionID  string
+	Topic           string
+	ResultsTopic    string
+	DeadLetterTopic string
+	MaxExtension    time.Duration
+	MessageDeadline time.Duration
+	MetricsAddr     string
+	Preflight       bool
+
+	ReceiveBackoff    time.Duration
+	ReceiveMaxBackoff time.Duration
+	ReceiveReadyAfter time.Duration
+
+	Source             string
+	Kafka              KafkaConfig
+	PushAddr           string
+	PushAudience       string
+	PushServiceAccount string
+
+	MaxOutstandingMessages int
+	NumGoroutines          int
+	SubscriptionsFile      string
+	Subscriptions          []Subscription
+	Verbose                bool
+	RedactFields           []string
+	SampleService          DownstreamConfig
+	PartyService           DownstreamConfig
+	Credentials            *Credentials
+
+	PayloadKeyFile            string
+	PayloadEncryptionRequired bool
+
+	SchemasFile          string
+	DefaultSchemaVersion string
+	CSV                  CSVOptions
+	BirthDateFormat      string
+	TransformsFile       string
+	DerivedFieldsFile    string
+	Ordering             Ordering
+}
+
+// DownstreamConfig holds the settings for a service the worker makes HTTP requests to
+type DownstreamConfig struct {
+	Name            string
+	BaseURL         string
+	Timeout         time.Duration
+	IdleConnTimeout time.Duration
+	Auth            string
+	BearerToken     string
+	BearerTokenFile string
+	Audience        string
+	TLS             TLSConfig
+	EmptyFields     string
+	RateLimit       float64
+	RateBurst       int
+	HealthPath      string
+}
+
+func setDefaults() {
+	viper.SetDefault("MESSAGE_SOURCE", sourcePubSub)
+	viper.SetDefault("KAFKA_TOPIC", "sample-file")
+	viper.SetDefault("KAFKA_GROUP", "csv-worker")
+	viper.SetDefault("KAFKA_MAX_ATTEMPTS", 5)
+	viper.SetDefault("KAFKA_RETRY_BACKOFF", "10s")
+	viper.SetDefault("PUBSUB_SUB_ID", "sample-file")
+	viper.SetDefault("PUBSUB_TOPIC", "sample-file")
+	viper.SetDefault("PUBSUB_RESULTS_TOPIC", "")
+	viper.SetDefault("PUBSUB_DEAD_LETTER_TOPIC", "")
+	viper.SetDefault("PUBSUB_MAX_EXTENSION", "60m")
+	viper.SetDefault("MESSAGE_DEADLINE", "10m")
+	viper.SetDefault("PUBSUB_RECEIVE_BACKOFF", "1s")
+	viper.SetDefault("PUBSUB_RECEIVE_MAX_BACKOFF", "1m")
+	viper.SetDefault("PUBSUB_RECEIVE_READY_AFTER", "10s")
+	viper.SetDefault("PUBSUB_MAX_OUTSTANDING_MESSAGES", pubsub.DefaultReceiveSettings.MaxOutstandingMessages)
+	viper.SetDefault("PUBSUB_NUM_GOROUTINES", pubsub.DefaultReceiveSettings.NumGoroutines)
+	viper.SetDefault("DEFAULT_SCHEMA_VERSION", sampleSchemaV1.Version)
+	viper.SetDefault("CSV_FIELD_COUNT", fieldCountExact)
+	viper.SetDefault("CSV_ENCODING", encodingUTF8)
+	viper.SetDefault("BIRTHDATE_FORMAT", birthDateLayout)
+	viper.SetDefault("ORDERING_KEY", orderingNone)
+	viper.SetDefault("GOOGLE_CLOUD_PROJECT", "rm-ras-sandbox")
+	viper.SetDefault("VERBOSE", true)
+	viper.SetDefault("PAYLOAD_ENCRYPTION_REQUIRED", false)
+	viper.SetDefault("REDACT_FIELDS", defaultRedactFields)
+	viper.SetDefault("SAMPLE_SERVICE_BASE_URL", "http://localhost:8080")
+	viper.SetDefault("SAMPLE_SERVICE_TIMEOUT", "30s")
+	viper.SetDefault("SAMPLE_SERVICE_IDLE_CONN_TIMEOUT", "1500ms")
+	viper.SetDefault("SAMPLE_SERVICE_AUTH", authNone)
+	viper.SetDefault("SAMPLE_SERVICE_EMPTY_FIELDS", emptyFieldsNull)
+	viper.SetDefault("SAMPLE_SERVICE_RATE_BURST", 1)
+	viper.SetDefault("SAMPLE_SERVICE_HEALTH_PATH", "/info")
+	viper.SetDefault("PARTY_SERVICE_BASE_URL", "http://localhost:8080")
+	viper.SetDefault("PARTY_SERVICE_TIMEOUT", "30s")
+	// Gunicorn closes idle connections after 2 secs
+	viper.SetDefault("PARTY_SERVICE_IDLE_CONN_TIMEOUT", "1500ms")
+	viper.SetDefault("PARTY_SERVICE_AUTH", authBasic)
+	viper.SetDefault("PARTY_SERVICE_EMPTY_FIELDS", emptyFieldsNull)
+	viper.SetDefault("PARTY_SERVICE_RATE_BURST", 1)
+	viper.SetDefault("PARTY_SERVICE_HEALTH_PATH", "/info")
+	viper.SetDefault("PREFLIGHT_CHECKS", true)
+}
+
+func loadConfig() (*Config, error) {
+	credentials, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	subscriptions, err := loadSubscriptions(viper.GetString("SUBSCRIPTIONS_FILE"), viper.GetString("PUBSUB_SUB_ID"))
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		ProjectID:       viper.GetString("GOOGLE_CLOUD_PROJECT"),
+		SubscriptionID:  viper.GetString("PUBSUB_SUB_ID"),
+		Topic:           viper.GetString("PUBSUB_TOPIC"),
+		ResultsTopic:    viper.GetString("PUBSUB_RESULTS_TOPIC"),
+		DeadLetterTopic: viper.GetString("PUBSUB_DEAD_LETTER_TOPIC"),
+		MaxExtension:    viper.GetDuration("PUBSUB_MAX_EXTENSION"),
+		MessageDeadline: viper.GetDuration("MESSAGE_DEADLINE"),
+		MetricsAddr:     viper.GetString("METRICS_ADDR"),
+		Preflight:       viper.GetBool("PREFLIGHT_CHECKS"),
+
+		ReceiveBackoff:    viper.GetDuration("PUBSUB_RECEIVE_BACKOFF"),
+		ReceiveMaxBackoff: viper.GetDuration("PUBSUB_RECEIVE_MAX_BACKOFF"),
+		ReceiveReadyAfter: viper.GetDuration("PUBSUB_RECEIVE_READY_AFTER"),
+
+		Source:             viper.GetString("MESSAGE_SOURCE"),
+		Kafka:              loadKafkaConfig(),
+		PushAddr:           viper.GetString("PUSH_ADDR"),
+		PushAudience:       viper.GetString("PUSH_AUDIENCE"),
+		PushServiceAccount: viper.GetString("PUSH_SERVICE_ACCOUNT"),
+
+		MaxOutstandingMessages: viper.GetInt("PUBSUB_MAX_OUTSTANDING_MESSAGES"),
+		NumGoroutines:          viper.GetInt("PUBSUB_NUM_GOROUTINES"),
+		SubscriptionsFile:      viper.GetString("SUBSCRIPTIONS_FILE"),
+		Subscriptions:          subscriptions,
+		Verbose:                viper.GetBool("VERBOSE"),
+		RedactFields:           splitList(viper.GetString("REDACT_FIELDS")),
+		SampleService:          loadDownstreamConfig("sample", "SAMPLE_SERVICE"),
+		PartyService:           loadDownstreamConfig("party", "PARTY_SERVICE"),
+		Credentials:            credentials,
+
+		PayloadKeyFile:            viper.GetString("PAYLOAD_KEY_FILE"),
+		PayloadEncryptionRequired: viper.GetBool("PAYLOAD_ENCRYPTION_REQUIRED"),
+
+		SchemasFile:          viper.GetString("SCHEMAS_FILE"),
+		DefaultSchemaVersion: viper.GetString("DEFAULT_SCHEMA_VERSION"),
+		CSV:                  loadCSVOptions(),
+		BirthDateFormat:      viper.GetString("BIRTHDATE_FORMAT"),
+		TransformsFile:       viper.GetString("TRANSFORMS_FILE"),
+		DerivedFieldsFile:    viper.GetString("DERIVED_FIELDS_FILE"),
+		Ordering:             loadOrdering(),
+	}, nil
+}
+
+func loadDownstreamConfig(name string, prefix string) DownstreamConfig {
+	return DownstreamConfig{
+		Name:            name,
+		BaseURL:         viper.GetString(prefix + "_BASE_URL"),
+		Timeout:         viper.GetDuration(prefix + "_TIMEOUT"),
+		IdleConnTimeout: viper.GetDuration(prefix + "_IDLE_CONN_TIMEOUT"),
+		Auth:            viper.GetString(prefix + "_AUTH"),
+		BearerToken:     viper.GetString(prefix + "_BEARER_TOKEN"),
+		BearerTokenFile: viper.GetString(prefix + "_BEARER_TOKEN_FILE"),
+		Audience:        viper.GetString(prefix + "_AUDIENCE"),
+		TLS: TLSConfig{
+			CAFile:     viper.GetString(prefix + "_TLS_CA_FILE"),
+			CertFile:   viper.GetString(prefix + "_TLS_CERT_FILE"),
+			KeyFile:    viper.GetString(prefix + "_TLS_KEY_FILE"),
+			MinVersion: viper.GetString(prefix + "_TLS_MIN_VERSION"),
+			ServerName: viper.GetString(prefix + "_TLS_SERVER_NAME"),
+		},
+		EmptyFields: viper.GetString(prefix + "_EMPTY_FIELDS"),
+		RateLimit:   viper.GetFloat64(prefix + "_RATE_LIMIT"),
+		RateBurst:   viper.GetInt(prefix + "_RATE_BURST"),
+		HealthPath:  viper.GetString(prefix + "_HEALTH_PATH"),
+	}
+}
+
+// audience defaults to the base url, which is what Cloud Run expects
+func (d DownstreamConfig) audience() string {
+	if d.Audience != "" {
+		return d.Audience
+	}
+	return d.BaseURL
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	if c.ProjectID == "" {
+		errs = append(errs, errors.New("GOOGLE_CLOUD_PROJECT is required"))
+	}
+	if c.SubscriptionID == "" {
+		errs = append(errs, errors.New("PUBSUB_SUB_ID is required"))
+	}
+	if c.PayloadEncryptionRequired && c.PayloadKeyFile == "" {
+		errs = append(errs, errors.New("PAYLOAD_KEY_FILE is required when PAYLOAD_ENCRYPTION_REQUIRED is set"))
+	}
+	// credentials are only required when a downstream service uses basic auth
+	if c.SampleService.Auth == authBasic || c.PartyService.Auth == authBasic {
+		errs = append(errs, c.Credentials.validate())
+	}
+	if err := c.CSV.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("CSV options are invalid: %w", err))
+	}
+	if err := validateDateFormat(c.BirthDateFormat); err != nil {
+		errs = append(errs, fmt.Errorf("BIRTHDATE_FORMAT %w", err))
+	}
+	if c.MaxOutstandingMessages <= 0 || c.NumGoroutines <= 0 {
+		errs = append(errs, errors.New("PUBSUB_MAX_OUTSTANDING_MESSAGES and PUBSUB_NUM_GOROUTINES must be greater than zero"))
+	}
+	errs = append(errs, validateSubscriptions(c.Subscriptions))
+	for _, sub := range c.Subscriptions {
+		if sub.SampleServiceBaseURL != "" {
+			errs = append(errs, validateBaseURL(sub.ID+" sampleServiceBaseUrl", sub.SampleServiceBaseURL))
+		}
+		if sub.PartyServiceBaseURL != "" {
+			errs = append(errs, validateBaseURL(sub.ID+" partyServiceBaseUrl", sub.PartyServiceBaseURL))
+		}
+	}
+	switch c.Source {
+	case sourcePubSub:
+	case sourceKafka:
+		errs = append(errs, c.Kafka.validate())
+		if c.PushAddr != "" || c.SubscriptionsFile != "" || c.DeadLetterTopic != "" {
+			errs = append(errs, errors.New("PUSH_ADDR, SUBSCRIPTIONS_FILE and PUBSUB_DEAD_LETTER_TOPIC can't be used with a kafka message source"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("MESSAGE_SOURCE must be %s or %s", sourcePubSub, sourceKafka))
+	}
+	if c.PushServiceAccount != "" && c.PushAudience == "" {
+		errs = append(errs, errors.New("PUSH_AUDIENCE is required when PUSH_SERVICE_ACCOUNT is set"))
+	}
+	if c.MaxExtension <= 0 {
+		errs = append(errs, errors.New("PUBSUB_MAX_EXTENSION must be greater than zero"))
+	}
+	// pubsub stops extending the ack deadline after PUBSUB_MAX_EXTENSION and redelivers the
+	// message, so the worker has to have given up on it by then
+	if c.MessageDeadline <= 0 || c.MessageDeadline >= c.MaxExtension {
+		errs = append(errs, errors.New("MESSAGE_DEADLINE must be greater than zero and less than PUBSUB_MAX_EXTENSION"))
+	}
+	if c.ReceiveBackoff <= 0 || c.ReceiveMaxBackoff < c.ReceiveBackoff {
+		errs = append(errs, errors.New("PUBSUB_RECEIVE_BACKOFF must be greater than zero and no more than PUBSUB_RECEIVE_MAX_BACKOFF"))
+	}
+	if c.ReceiveReadyAfter <= 0 {
+		errs = append(errs, errors.New("PUBSUB_RECEIVE_READY_AFTER must be greater than zero"))
+	}
+	errs = append(errs, c.Ordering.validate())
+	errs = append(errs, c.SampleService.validate("SAMPLE_SERVICE"))
+	errs = append(errs, c.PartyService.validate("PARTY_SERVICE"))
+	return errors.Join(errs...)
+}
+
+func (d DownstreamConfig) validate(prefix string) error {
+	var errs []error
+	errs = append(errs, validateBaseURL(prefix+"_BASE_URL", d.BaseURL))
+	if d.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s_TIMEOUT must be greater than zero", prefix))
+	}
+	if d.IdleConnTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s_IDLE_CONN_TIMEOUT must be greater than zero", prefix))
+	}
+	switch d.Auth {
+	case authNone, authBasic, authIdToken:
+	case authBearer:
+		if d.BearerToken == "" && d.BearerTokenFile == "" {
+			errs = append(errs, fmt.Errorf("%s_BEARER_TOKEN or %s_BEARER_TOKEN_FILE is required for bearer auth", prefix, prefix))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s_AUTH must be one of %s, %s, %s or %s", prefix, authNone, authBasic, authBearer, authIdToken))
+	}
+	if d.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("%s_RATE_LIMIT must not be negative", prefix))
+	} else if d.RateLimit > 0 && d.RateBurst < 1 {
+		errs = append(errs, fmt.Errorf("%s_RATE_BURST must be at least 1", prefix))
+	}
+	if d.HealthPath != "" && !strings.HasPrefix(d.HealthPath, "/") {
+		errs = append(errs, fmt.Errorf("%s_HEALTH_PATH must start with /", prefix))
+	}
+	if d.EmptyFields != emptyFieldsNull && d.EmptyFields != emptyFieldsOmit {
+		errs = append(errs, fmt.Errorf("%s_EMPTY_FIELDS must be %s or %s", prefix, emptyFieldsNull, emptyFieldsOmit))
+	}
+	errs = append(errs, d.TLS.validate(prefix))
+	return errors.Join(errs...)
+}
+
+func validateBaseURL(name string, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", name)
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid url: %w", name, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an absolute http or https url", name)
+	}
+	return nil
+}
+
+// MarshalLogObject allows the config to be logged at startup without leaking secrets
+func (c *Config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("projectId", c.ProjectID)
+	enc.AddString("subscriptionId", c.SubscriptionID)
+	enc.AddString("topic", c.Topic)
+	enc.AddString("resultsTopic", c.ResultsTopic)
+	enc.AddString("deadLetterTopic", c.DeadLetterTopic)
+	enc.AddDuration("maxExtension", c.MaxExtension)
+	enc.AddDuration("messageDeadline", c.MessageDeadline)
+	enc.AddString("metricsAddr", c.MetricsAddr)
+	enc.AddBool("preflight", c.Preflight)
+	enc.AddDuration("receiveBackoff", c.ReceiveBackoff)
+	enc.AddDuration("receiveMaxBackoff", c.ReceiveMaxBackoff)
+	enc.AddDuration("receiveReadyAfter", c.ReceiveReadyAfter)
+	enc.AddString("source", c.Source)
+	if c.Source == sourceKafka {
+		if err := enc.AddObject("kafka", c.Kafka); err != nil {
+			return err
+		}
+	}
+	enc.AddString("pushAddr", c.PushAddr)
+	enc.AddString("pushAudience", c.PushAudience)
+	enc.AddString("pushServiceAccount", c.PushServiceAccount)
+	enc.AddInt("maxOutstandingMessages", c.MaxOutstandingMessages)
+	enc.AddInt("numGoroutines", c.NumGoroutines)
+	enc.AddString("subscriptionsFile", c.SubscriptionsFile)
+	if err := enc.AddArray("subscriptions", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+		for _, sub := range c.Subscriptions {
+			if err := arr.AppendObject(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	})); err != nil {
+		return err
+	}
+	enc.AddString("schemasFile", c.SchemasFile)
+	enc.AddString("defaultSchemaVersion", c.DefaultSchemaVersion)
+	enc.AddString("birthDateFormat", c.BirthDateFormat)
+	enc.AddString("transformsFile", c.TransformsFile)
+	enc.AddString("derivedFieldsFile", c.DerivedFieldsFile)
+	enc.AddBool("verbose", c.Verbose)
+	enc.AddString("redactFields", strings.Join(c.RedactFields, ","))
+	enc.AddString("payloadKeyFile", c.PayloadKeyFile)
+	enc.AddBool("payloadEncryptionRequired", c.PayloadEncryptionRequired)
+	if err := enc.AddObject("csv", c.CSV); err != nil {
+		return err
+	}
+	if err := enc.AddObject("ordering", c.Ordering); err != nil {
+		return err
+	}
+	if err := enc.AddObject("credentials", c.Credentials); err != nil {
+		return err
+	}
+	if err := enc.AddObject("sampleService", c.SampleService); err != nil {
+		return err
+	}
+	return enc.AddObject("partyService", c.PartyService)
+}
+
+func (d DownstreamConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("baseUrl", d.BaseURL)
+	enc.AddDuration("timeout", d.Timeout)
+	enc.AddDuration("idleConnTimeout", d.IdleConnTimeout)
+	enc.AddString("auth", d.Auth)
+	enc.AddString("bearerToken", redactIfSet(d.BearerToken))
+	enc.AddString("bearerTokenFile", d.BearerTokenFile)
+	enc.AddString("audience", d.Audience)
+	enc.AddString("emptyFields", d.EmptyFields)
+	enc.AddFloat64("rateLimit", d.RateLimit)
+	enc.AddInt("rateBurst", d.RateBurst)
+	enc.AddString("healthPath", d.HealthPath)
+	return enc.AddObject("tls", d.TLS)
+}
+
+func (t TLSConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("caFile", t.CAFile)
+	enc.AddString("certFile", t.CertFile)
+	enc.AddString("keyFile", t.KeyFile)
+	enc.AddString("minVersion", t.MinVersion)
+	enc.AddString("serverName", t.ServerName)
+	return nil
+}
+
+func redactIfSet(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redacted
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	assert := assert.New(t)
+	setDefaults()
+
+	config, err := loadConfig()
+	assert.Nil(err)
+	assert.Equal("rm-ras-sandbox", config.ProjectID)
+	assert.Equal("sample-file", config.SubscriptionID)
+	assert.Equal("http://localhost:8080", config.SampleService.BaseURL)
+	assert.Equal(30*time.Second, config.PartyService.Timeout)
+	assert.Equal(1500*time.Millisecond, config.PartyService.IdleConnTimeout)
+	assert.Equal(CSVOptions{FieldCount: fieldCountExact, Encoding: encodingUTF8}, config.CSV)
+	// there are deliberately no default credentials
+	err = config.validate()
+	assert.ErrorContains(err, "SECURITY_USER_NAME is required")
+	assert.ErrorContains(err, "SECURITY_USER_PASSWORD is required")
+}
+
+func TestValidConfig(t *testing.T) {
+	assert.Nil(t, testConfig().validate())
+}
+
+func TestConfigMissingRequiredValues(t *testing.T) {
+	assert := assert.New(t)
+	config := testConfig()
+	config.ProjectID = ""
+	config.SubscriptionID = ""
+
+	err := config.validate()
+	assert.ErrorContains(err, "GOOGLE_CLOUD_PROJECT is required")
+	assert.ErrorContains(err, "PUBSUB_SUB_ID is required")
+}
+
+func TestConfigInvalidBaseUrl(t *testing.T) {
+	assert := assert.New(t)
+	config := testConfig()
+	config.SampleService.BaseURL = "localhost:8080"
+	config.PartyService.BaseURL = "http://[::1"
+
+	err := config.validate()
+	assert.ErrorContains(err, "SAMPLE_SERVICE_BASE_URL must be an absolute http or https url")
+	assert.ErrorContains(err, "PARTY_SERVICE_BASE_URL is not a valid url")
+}
+
+func TestConfigInvalidDurations(t *testing.T) {
+	assert := assert.New(t)
+	config := testConfig()
+	config.PartyService.Timeout = 0
+	config.SampleService.IdleConnTimeout = -1 * time.Second
+
+	err := config.validate()
+	assert.ErrorContains(err, "PARTY_SERVICE_TIMEOUT must be greater than zero")
+	assert.ErrorContains(err, "SAMPLE_SERVICE_IDLE_CONN_TIMEOUT must be greater than zero")
+}
+
+func TestConfigDurationFromEnvironment(t *testing.T) {
+	assert := assert.New(t)
+	setDefaults()
+	viper.Set("SAMPLE_SERVICE_TIMEOUT", "5s")
+	defer viper.Set("SAMPLE_SERVICE_TIMEOUT", "30s")
+
+	config, err := loadConfig()
+	assert.Nil(err)
+	assert.Equal(5*time.Second, config.SampleService.Timeout)
+}
+
+func TestConfigLogRedactsSecrets(t *testing.T) {
+	assert := assert.New(t)
+	enc := zapcore.NewMapObjectEncoder()
+
+	err := testConfig().MarshalLogObject(enc)
+	assert.Nil(err)
+	credentials := enc.Fields["credentials"].(map[string]interface{})
+	assert.Equal("admin", credentials["username"])
+	assert.Equal(redacted, credentials["password"])
+}
+
+func TestConfigAuthValidation(t *testing.T) {
+	assert := assert.New(t)
+	config := testConfig()
+	config.SampleService.Auth = "digest"
+	config.PartyService.Auth = authBearer
+
+	err := config.validate()
+	assert.ErrorContains(err, "SAMPLE_SERVICE_AUTH must be one of")
+	assert.ErrorContains(err, "PARTY_SERVICE_BEARER_TOKEN or PARTY_SERVICE_BEARER_TOKEN_FILE is required")
+}
+
+func TestConfigCredentialsOnlyRequiredForBasicAuth(t *testing.T) {
+	config := testConfig()
+	config.Credentials = newStaticCredentials("", "")
+	assert.NotNil(t, config.validate())
+
+	config.PartyService.Auth = authIdToken
+	assert.Nil(t, config.validate())
+}
+
+func TestConfigEncryptionRequiresKey(t *testing.T) {
+	config := testConfig()
+	config.PayloadEncryptionRequired = true
+	assert.ErrorContains(t, config.validate(), "PAYLOAD_KEY_FILE is required")
+
+	config.PayloadKeyFile = "/var/secrets/payload-key/key"
+	assert.Nil(t, config.validate())
+}
+
+func TestConfigInvalidCSVOptions(t *testing.T) {
+	config := testConfig()
+	config.CSV.Encoding = "ebcdic"
+	assert.ErrorContains(t, config.validate(), "CSV options are invalid: encoding must be one of")
+}
+
+func TestConfigInvalidBirthDateFormat(t *testing.T) {
+	config := testConfig()
+	config.BirthDateFormat = "dd/mm/yyyy"
+	assert.ErrorContains(t, config.validate(), "BIRTHDATE_FORMAT \"dd/mm/yyyy\" is not a date layout")
+}
+
+func TestConfigEmptyFieldsValidation(t *testing.T) {
+	config := testConfig()
+	config.PartyService.EmptyFields = emptyFieldsOmit
+	assert.Nil(t, config.validate())
+
+	config.SampleService.EmptyFields = "zero"
+	assert.ErrorContains(t, config.validate(), "SAMPLE_SERVICE_EMPTY_FIELDS must be null or omit")
+}
+
+func TestConfigRateLimitValidation(t *testing.T) {
+	config := testConfig()
+	config.PartyService.RateLimit = 20
+	config.PartyService.RateBurst = 5
+	assert.Nil(t, config.validate())
+
+	config.PartyService.RateBurst = 0
+	assert.ErrorContains(t, config.validate(), "PARTY_SERVICE_RATE_BURST must be at least 1")
+	config.SampleService.RateLimit = -1
+	assert.ErrorContains(t, config.validate(), "SAMPLE_SERVICE_RATE_LIMIT must not be negative")
+	config.MaxExtension = 0
+	assert.ErrorContains(t, config.validate(), "PUBSUB_MAX_EXTENSION must be greater than zero")
+	config.MessageDeadline = config.MaxExtension
+	assert.ErrorContains(t, config.validate(), "MESSAGE_DEADLINE must be greater than zero and less than PUBSUB_MAX_EXTENSION")
+	config.SampleService.HealthPath = "info"
+	assert.ErrorContains(t, config.validate(), "SAMPLE_SERVICE_HEALTH_PATH must start with /")
+	config.ReceiveMaxBackoff = config.ReceiveBackoff / 2
+	assert.ErrorContains(t, config.validate(), "PUBSUB_RECEIVE_BACKOFF must be greater than zero and no more than PUBSUB_RECEIVE_MAX_BACKOFF")
+	config.ReceiveReadyAfter = 0
+	assert.ErrorContains(t, config.validate(), "PUBSUB_RECEIVE_READY_AFTER must be greater than zero")
+}
+
+func TestConfigPushServiceAccountRequiresAudience(t *testing.T) {
+	config := testConfig()
+	config.PushServiceAccount = "pusher@rm-ras-sandbox.iam.gserviceaccount.com"
+	assert.ErrorContains(t, config.validate(), "PUSH_AUDIENCE is required when PUSH_SERVICE_ACCOUNT is set")
+
+	config.PushAudience = "https://worker.example.com/push"
+	assert.Nil(t, config.validate())
+}
+
+func TestConfigKafkaValidation(t *testing.T) {
+	config := testConfig()
+	config.Source = sourceKafka
+	err := config.validate()
+	assert.ErrorContains(t, err, "KAFKA_BROKERS is required")
+	assert.ErrorContains(t, err, "KAFKA_DEAD_LETTER_TOPIC is required")
+
+	config.Kafka = KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "sample-file", Group: "csv-worker", DeadLetterTopic: "sample-file-dlq", MaxAttempts: 5}
+	assert.Nil(t, config.validate())
+
+	config.PushAddr = ":8080"
+	assert.ErrorContains(t, config.validate(), "can't be used with a kafka message source")
+
+	config.Source = "nats"
+	assert.ErrorContains(t, config.validate(), "MESSAGE_SOURCE must be pubsub or kafka")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// file names match the keys of the security-credentials kubernetes secret
+const (
+	securityUserFile     = "security-user"
+	securityPasswordFile = "security-password"
+)
+
+// Credentials holds the basic auth username and password for downstream services. When they
+// are loaded from a mounted secret directory they are re-read whenever the files change, so a
+// rotated password is picked up without restarting the worker
+type Credentials struct {
+	mu       sync.RWMutex
+	username string
+	password string
+	dir      string
+	watcher  *fsnotify.Watcher
+}
+
+func loadCredentials() (*Credentials, error) {
+	dir := viper.GetString("SECURITY_CREDENTIALS_DIR")
+	if dir == "" {
+		return newStaticCredentials(viper.GetString("SECURITY_USER_NAME"), viper.GetString("SECURITY_USER_PASSWORD")), nil
+	}
+	c := &Credentials{dir: dir}
+	return c, c.reload()
+}
+
+func newStaticCredentials(username string, password string) *Credentials {
+	return &Credentials{username: username, password: password}
+}
+
+func (c *Credentials) get() (string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username, c.password
+}
+
+func (c *Credentials) validate() error {
+	username, password := c.get()
+	var errs []error
+	if username == "" {
+		errs = append(errs, errors.New("SECURITY_USER_NAME is required"))
+	}
+	if password == "" {
+		errs = append(errs, errors.New("SECURITY_USER_PASSWORD is required"))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Credentials) reload() error {
+	username, err := readSecretFile(filepath.Join(c.dir, securityUserFile))
+	if err != nil {
+		return err
+	}
+	password, err := readSecretFile(filepath.Join(c.dir, securityPasswordFile))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username = username
+	c.password = password
+	return nil
+}
+
+func readSecretFile(path string) (string, error) {
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(value), "\r\n"), nil
+}
+
+// watch reloads the credentials whenever the secret directory changes. Kubernetes updates
+// mounted secrets by swapping a symlink within the directory, so the directory is watched
+// rather than the individual files
+func (c *Credentials) watch() error {
+	if c.dir == "" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(c.dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	c.watcher = watcher
+	go func() {
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if err := c.reload(); err != nil {
+					logger.Error("unable to reload security credentials - keeping previous credentials", zap.Error(err))
+					continue
+				}
+				logger.Debug("security credentials reloaded", zap.String("dir", c.dir))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("error watching security credentials", zap.Error(err))
+			}
+		}
+	}()
+	logger.Info("watching security credentials for changes", zap.String("dir", c.dir))
+	return nil
+}
+
+func (c *Credentials) close() {
+	if c.watcher != nil {
+		c.watcher.Close()
+	}
+}
+
+func (c *Credentials) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	username, password := c.get()
+	enc.AddString("dir", c.dir)
+	enc.AddString("username", username)
+	enc.AddString("password", redactIfSet(password))
+	return nil
+}
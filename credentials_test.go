@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCredentials(t *testing.T, dir string, username string, password string) {
+	err := os.WriteFile(filepath.Join(dir, securityUserFile), []byte(username+"\n"), 0600)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(dir, securityPasswordFile), []byte(password+"\n"), 0600)
+	assert.Nil(t, err)
+}
+
+func TestCredentialsFromEnvironment(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("SECURITY_USER_NAME", "user")
+	viper.Set("SECURITY_USER_PASSWORD", "password")
+	defer viper.Set("SECURITY_USER_NAME", "")
+	defer viper.Set("SECURITY_USER_PASSWORD", "")
+
+	credentials, err := loadCredentials()
+	assert.Nil(err)
+	username, password := credentials.get()
+	assert.Equal("user", username)
+	assert.Equal("password", password)
+	assert.Nil(credentials.validate())
+}
+
+func TestCredentialsFromSecretDirectory(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	writeCredentials(t, dir, "file-user", "file-password")
+	viper.Set("SECURITY_CREDENTIALS_DIR", dir)
+	defer viper.Set("SECURITY_CREDENTIALS_DIR", "")
+
+	credentials, err := loadCredentials()
+	assert.Nil(err)
+	username, password := credentials.get()
+	assert.Equal("file-user", username)
+	assert.Equal("file-password", password)
+}
+
+func TestCredentialsMissingSecretFile(t *testing.T) {
+	viper.Set("SECURITY_CREDENTIALS_DIR", t.TempDir())
+	defer viper.Set("SECURITY_CREDENTIALS_DIR", "")
+
+	_, err := loadCredentials()
+	assert.NotNil(t, err)
+}
+
+func TestCredentialsRequired(t *testing.T) {
+	err := newStaticCredentials("", "").validate()
+	assert.ErrorContains(t, err, "SECURITY_USER_NAME is required")
+	assert.ErrorContains(t, err, "SECURITY_USER_PASSWORD is required")
+}
+
+func TestCredentialsReloadedOnRotation(t *testing.T) {
+	configureLogging(true)
+	assert := assert.New(t)
+	dir := t.TempDir()
+	writeCredentials(t, dir, "user", "old-password")
+
+	credentials := &Credentials{dir: dir}
+	assert.Nil(credentials.reload())
+	assert.Nil(credentials.watch())
+	defer credentials.close()
+
+	writeCredentials(t, dir, "user", "new-password")
+	assert.Eventually(func() bool {
+		_, password := credentials.get()
+		return password == "new-password"
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	fieldCountAny     = "any"
+	fieldCountExact   = "exact"
+	fieldCountMinimum = "minimum"
+
+	encodingUTF8        = "utf-8"
+	encodingLatin1      = "latin1"
+	encodingWindows1252 = "windows-1252"
+)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// CSVOptions controls how strictly a csv line is parsed. The zero value accepts anything
+// encoding/csv does, as the worker always has
+type CSVOptions struct {
+	// FieldCount is exact or minimum to require the number of schema columns, or any
+	FieldCount string `json:"fieldCount"`
+	// LazyQuotes allows quotes to appear in unquoted fields, and unescaped in quoted ones
+	LazyQuotes bool `json:"lazyQuotes"`
+	// Encoding is utf-8 to reject invalid UTF-8, or latin1 or windows-1252 to transcode
+	// legacy IDBR extracts to UTF-8
+	Encoding string `json:"encoding"`
+	// NormaliseSpace trims each field and collapses runs of whitespace to a single space
+	NormaliseSpace bool `json:"normaliseSpace"`
+}
+
+func loadCSVOptions() CSVOptions {
+	return CSVOptions{
+		FieldCount:     viper.GetString("CSV_FIELD_COUNT"),
+		LazyQuotes:     viper.GetBool("CSV_LAZY_QUOTES"),
+		Encoding:       viper.GetString("CSV_ENCODING"),
+		NormaliseSpace: viper.GetBool("CSV_NORMALISE_SPACE"),
+	}
+}
+
+func (o CSVOptions) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("fieldCount", o.FieldCount)
+	enc.AddBool("lazyQuotes", o.LazyQuotes)
+	enc.AddString("encoding", o.Encoding)
+	enc.AddBool("normaliseSpace", o.NormaliseSpace)
+	return nil
+}
+
+func (o CSVOptions) validate() error {
+	var errs []error
+	switch o.FieldCount {
+	case "", fieldCountAny, fieldCountExact, fieldCountMinimum:
+	default:
+		errs = append(errs, fmt.Errorf("field count must be one of %s, %s or %s", fieldCountAny, fieldCountExact, fieldCountMinimum))
+	}
+	switch strings.ToLower(o.Encoding) {
+	case "", encodingUTF8, encodingLatin1, encodingWindows1252:
+	default:
+		errs = append(errs, fmt.Errorf("encoding must be one of %s, %s or %s", encodingUTF8, encodingLatin1, encodingWindows1252))
+	}
+	return errors.Join(errs...)
+}
+
+// decode strips any byte order mark and transcodes the line to UTF-8
+func (o CSVOptions) decode(line []byte) ([]byte, error) {
+	// the mark is stripped before transcoding, which would turn it into characters of the first field
+	line = bytes.TrimPrefix(line, utf8BOM)
+	switch strings.ToLower(o.Encoding) {
+	case encodingLatin1:
+		return charmap.ISO8859_1.NewDecoder().Bytes(line)
+	case encodingWindows1252:
+		return charmap.Windows1252.NewDecoder().Bytes(line)
+	default:
+		return line, nil
+	}
+}
+
+// check reports the first problem with the fields of a line, giving the position and name of
+// the column so the line can be fixed at source
+func (o CSVOptions) check(values []string, columns []string) error {
+	switch {
+	case o.FieldCount == fieldCountExact && len(values) != len(columns):
+		return fieldCountError(values, columns, "exactly")
+	case o.FieldCount == fieldCountMinimum && len(values) < len(columns):
+		return fieldCountError(values, columns, "at least")
+	}
+	if strings.EqualFold(o.Encoding, encodingUTF8) {
+		for i, value := range values {
+			if !utf8.ValidString(value) {
+				return fmt.Errorf("invalid UTF-8 in column %d (%s)", i+1, columnName(columns, i))
+			}
+		}
+	}
+	return nil
+}
+
+func fieldCountError(values []string, columns []string, expected string) error {
+	if len(values) < len(columns) {
+		return fmt.Errorf("expected %s %d fields but found %d - missing from column %d (%s)",
+			expected, len(columns), len(values), len(values)+1, columns[len(values)])
+	}
+	return fmt.Errorf("expected %s %d fields but found %d - unexpected column %d",
+		expected, len(columns), len(values), len(columns)+1)
+}
+
+func columnName(columns []string, i int) string {
+	if i < len(columns) {
+		return columns[i]
+	}
+	return "unknown"
+}
+
+func (o CSVOptions) normalise(values []string) {
+	if !o.NormaliseSpace {
+		return
+	}
+	for i, value := range values {
+		values[i] = strings.Join(strings.Fields(value), " ")
+	}
+}
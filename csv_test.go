@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var strictSchema = &Schema{
+	Version:   "1",
+	Format:    formatCSV,
+	Delimiter: ":",
+	Columns:   sampleColumns,
+	CSV:       CSVOptions{FieldCount: fieldCountExact, Encoding: encodingUTF8},
+}
+
+func TestExactFieldCount(t *testing.T) {
+	assert := assert.New(t)
+	row, err := readSampleLine([]byte(line), strictSchema)
+	assert.Nil(err)
+	assert.Equal("13110000001", row["SAMPLEUNITREF"])
+
+	_, err = readSampleLine([]byte("13110000001:::::::::::WW"), strictSchema)
+	assert.EqualError(err, "expected exactly 27 fields but found 12 - missing from column 13 (BIRTHDATE)")
+
+	_, err = readSampleLine([]byte(line+":extra"), strictSchema)
+	assert.EqualError(err, "expected exactly 27 fields but found 28 - unexpected column 28")
+}
+
+func TestMinimumFieldCount(t *testing.T) {
+	assert := assert.New(t)
+	schema := *strictSchema
+	schema.CSV.FieldCount = fieldCountMinimum
+
+	row, err := readSampleLine([]byte(line+":extra"), &schema)
+	assert.Nil(err)
+	assert.Equal("", row["CURRENCY"])
+
+	_, err = readSampleLine([]byte("13110000001"), &schema)
+	assert.EqualError(err, "expected at least 27 fields but found 1 - missing from column 2 (CHECKLETTER)")
+}
+
+func TestAnyFieldCount(t *testing.T) {
+	row, err := readSampleLine([]byte("13110000001:A"), sampleSchemaV1)
+	assert.Nil(t, err)
+	assert.Equal(t, Row{"SAMPLEUNITREF": "13110000001", "CHECKLETTER": "A"}, row)
+}
+
+func TestLazyQuotes(t *testing.T) {
+	assert := assert.New(t)
+	schema := &Schema{Version: "2", Format: formatCSV, Delimiter: ":", Columns: []string{"SAMPLEUNITREF", "RUNAME1"}}
+
+	_, err := readSampleLine([]byte("111:ACME \"THE\" LTD"), schema)
+	assert.ErrorContains(err, "column 10")
+
+	schema.CSV.LazyQuotes = true
+	row, err := readSampleLine([]byte("111:ACME \"THE\" LTD"), schema)
+	assert.Nil(err)
+	assert.Equal("ACME \"THE\" LTD", row["RUNAME1"])
+}
+
+func TestEncoding(t *testing.T) {
+	assert := assert.New(t)
+	schema := &Schema{Version: "2", Format: formatCSV, Delimiter: ":", Columns: []string{"SAMPLEUNITREF", "RUNAME1"}}
+	latin1 := []byte("111:CAF\xc9 LTD")
+
+	schema.CSV.Encoding = encodingUTF8
+	_, err := readSampleLine(latin1, schema)
+	assert.EqualError(err, "invalid UTF-8 in column 2 (RUNAME1)")
+
+	schema.CSV.Encoding = encodingLatin1
+	row, err := readSampleLine(latin1, schema)
+	assert.Nil(err)
+	assert.Equal("CAFÉ LTD", row["RUNAME1"])
+
+	schema.CSV.Encoding = encodingWindows1252
+	row, err = readSampleLine([]byte("111:ACME \x96 LTD"), schema)
+	assert.Nil(err)
+	assert.Equal("ACME – LTD", row["RUNAME1"])
+}
+
+func TestByteOrderMarkStripped(t *testing.T) {
+	row, err := readSampleLine(append(utf8BOM, line...), strictSchema)
+	assert.Nil(t, err)
+	assert.Equal(t, "13110000001", row["SAMPLEUNITREF"])
+
+	// a legacy extract can still start with one
+	for _, encoding := range []string{encodingLatin1, encodingWindows1252} {
+		schema := *strictSchema
+		schema.CSV.Encoding = encoding
+		row, err := readSampleLine(append(utf8BOM, line...), &schema)
+		assert.Nil(t, err)
+		assert.Equal(t, "13110000001", row["SAMPLEUNITREF"], encoding)
+	}
+}
+
+func TestNormaliseSpace(t *testing.T) {
+	assert := assert.New(t)
+	schema := &Schema{Version: "2", Format: formatCSV, Delimiter: ":", Columns: []string{"SAMPLEUNITREF", "RUNAME1"}}
+
+	row, err := readSampleLine([]byte(" 111 :  ACME   TRADING\tLTD "), schema)
+	assert.Nil(err)
+	assert.Equal("  ACME   TRADING\tLTD ", row["RUNAME1"])
+
+	schema.CSV.NormaliseSpace = true
+	row, err = readSampleLine([]byte(" 111 :  ACME   TRADING\tLTD "), schema)
+	assert.Nil(err)
+	assert.Equal(Row{"SAMPLEUNITREF": "111", "RUNAME1": "ACME TRADING LTD"}, row)
+}
+
+func TestValidateCSVOptions(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(CSVOptions{}.validate())
+	assert.Nil(CSVOptions{FieldCount: fieldCountMinimum, Encoding: "Windows-1252"}.validate())
+	assert.ErrorContains(CSVOptions{FieldCount: "some"}.validate(), "field count must be one of")
+	assert.ErrorContains(CSVOptions{Encoding: "ebcdic"}.validate(), "encoding must be one of")
+}
+
+func TestSchemaFileCSVOptions(t *testing.T) {
+	assert := assert.New(t)
+	file := writeSchemas(t, `[
+		{"version": "2", "delimiter": "|", "columns": ["SAMPLEUNITREF"]},
+		{"version": "3", "delimiter": "|", "columns": ["SAMPLEUNITREF"], "csv": {"fieldCount": "any"}}
+	]`)
+	schemas, err := loadSchemas(file, "1", CSVOptions{FieldCount: fieldCountExact, Encoding: encodingUTF8})
+	assert.Nil(err)
+
+	v1, _ := schemas.lookup(map[string]string{})
+	assert.Equal(fieldCountExact, v1.CSV.FieldCount)
+	// the built in schema is left as it is
+	assert.Equal("", sampleSchemaV1.CSV.FieldCount)
+
+	v2, _ := schemas.lookup(map[string]string{schemaVersionAttribute: "2"})
+	assert.Equal(CSVOptions{FieldCount: fieldCountExact, Encoding: encodingUTF8}, v2.CSV)
+
+	v3, _ := schemas.lookup(map[string]string{schemaVersionAttribute: "3"})
+	assert.Equal(CSVOptions{FieldCount: fieldCountAny, Encoding: encodingUTF8}, v3.CSV)
+
+	_, err = loadSchemas("", "1", CSVOptions{Encoding: "ebcdic"})
+	assert.ErrorContains(err, "schema 1 csv encoding must be one of")
+}
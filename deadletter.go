@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/zap"
+)
+
+const (
+	deadLetterReasonAttribute    = "dead_letter_reason"
+	deadLetterMessageIdAttribute = "original_message_id"
+)
+
+// DeadLetterPublisher handles messages that can never be processed, such as an unknown schema
+// version. When a dead letter topic is configured the message is published there straight away
+// with the reason attached and acked, rather than being retried until the subscription's dead
+// letter policy gives up on it
+type DeadLetterPublisher struct {
+	topic *pubsub.Topic
+}
+
+func newDeadLetterPublisher(client *pubsub.Client, topicId string) *DeadLetterPublisher {
+	if topicId == "" {
+		logger.Info("no dead letter topic configured - failed messages will be nacked")
+		return nil
+	}
+	logger.Info("publishing failed messages to dead letter topic", zap.String("topicId", topicId))
+	return &DeadLetterPublisher{topic: client.Topic(topicId)}
+}
+
+func (d *DeadLetterPublisher) deadLetter(ctx context.Context, msg Message, reason string) {
+	logger.Error("unable to process message - sending to DLQ", zap.String("messageId", msg.ID()), zap.String("reason", reason))
+	// a nil publisher means no dead letter topic has been configured
+	if d == nil {
+		if r, ok := msg.(rejecter); ok {
+			r.reject(reason)
+			return
+		}
+		//after x number of nacks message will be DLQ
+		msg.Nack()
+		return
+	}
+	id, err := d.publish(ctx, msg, reason)
+	if err != nil {
+		logger.Error("error publishing to dead letter topic - nacking message", zap.Error(err), zap.String("messageId", msg.ID()))
+		msg.Nack()
+		return
+	}
+	logger.Info("message published to dead letter topic - acking message", zap.String("messageId", msg.ID()), zap.String("deadLetterMessageId", id))
+	msg.Ack()
+}
+
+// publish sends the message to the dead letter topic with the reason attached, returning the
+// id it was published with
+func (d *DeadLetterPublisher) publish(ctx context.Context, msg Message, reason string) (string, error) {
+	attributes := map[string]string{}
+	for k, v := range msg.Attributes() {
+		attributes[k] = v
+	}
+	attributes[deadLetterReasonAttribute] = reason
+	attributes[deadLetterMessageIdAttribute] = msg.ID()
+	// the dead letter topic isn't ordered, so the key is kept as an attribute for replaying
+	if msg.OrderingKey() != "" {
+		attributes[orderingKeyAttribute] = msg.OrderingKey()
+	}
+	return d.topic.Publish(ctx, &pubsub.Message{Data: msg.Data(), Attributes: attributes}).Get(ctx)
+}
+
+func (d *DeadLetterPublisher) stop() {
+	if d == nil {
+		return
+	}
+	d.topic.Stop()
+}
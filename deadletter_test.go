@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestUnknownSchemaVersionDeadLettered(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	topic, err := createTopic(client, ctx, assert)
+	defer topic.Delete(ctx)
+	sub := createSubscription(client, ctx, err, topic, assert)
+	defer sub.Delete(ctx)
+	deadLetterTopic, err := client.CreateTopic(ctx, "sample-file-dlq")
+	assert.Nil(err)
+	defer deadLetterTopic.Delete(ctx)
+
+	msg := &pubsub.Message{
+		Data: []byte(line),
+		Attributes: map[string]string{
+			"sample_summary_id":    "test",
+			schemaVersionAttribute: "99",
+		},
+	}
+	id, err := topic.Publish(ctx, msg).Get(ctx)
+	assert.Nil(err)
+
+	config := testConfig()
+	config.DeadLetterTopic = "sample-file-dlq"
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(err)
+	subscribeUntilCleanup(t, worker, client)
+
+	time.Sleep(1 * time.Second)
+
+	messages := srv.Messages()
+	assert.Equal(2, len(messages))
+	for _, m := range messages {
+		if m.ID == id {
+			// the original is acked as it has been handed off to the dead letter topic
+			assert.Equal(1, m.Acks)
+		} else {
+			assert.Equal(line, string(m.Data))
+			assert.Equal("unknown schema version \"99\"", m.Attributes[deadLetterReasonAttribute])
+			assert.Equal(id, m.Attributes[deadLetterMessageIdAttribute])
+			assert.Equal("test", m.Attributes["sample_summary_id"])
+		}
+	}
+}
+
+func TestUnknownSchemaVersionNackedWithoutDeadLetterTopic(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	topic, err := createTopic(client, ctx, assert)
+	defer topic.Delete(ctx)
+	sub := createSubscription(client, ctx, err, topic, assert)
+	defer sub.Delete(ctx)
+
+	msg := &pubsub.Message{
+		Data: []byte(line),
+		Attributes: map[string]string{
+			"sample_summary_id":    "test",
+			schemaVersionAttribute: "99",
+		},
+	}
+	_, err = topic.Publish(ctx, msg).Get(ctx)
+	assert.Nil(err)
+
+	worker, err := newCSVWorker(ctx, testConfig())
+	assert.Nil(err)
+	subscribeUntilCleanup(t, worker, client)
+
+	time.Sleep(1 * time.Second)
+
+	messages := srv.Messages()
+	assert.Equal(1, len(messages))
+	assert.Equal(0, messages[0].Acks)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	deriveJoin  = "join"
+	deriveFirst = "first"
+	deriveBand  = "band"
+)
+
+// defaultDerivations are always applied unless the derived fields file redefines them
+var defaultDerivations = Derivations{
+	{Field: "name", Rule: deriveJoin, Columns: []string{"RUNAME1", "RUNAME2", "RUNAME3"}},
+}
+
+// Derivation computes a party attribute from the columns of a row, so that new attributes can be
+// added by configuration rather than by changing Attributes. A join rule joins the non empty
+// columns with the separator (a space by default), a first rule takes the first non empty column
+// and a band rule finds the band a number falls in
+type Derivation struct {
+	Field     string   `json:"field"`
+	Rule      string   `json:"rule"`
+	Columns   []string `json:"columns"`
+	Separator string   `json:"separator"`
+	Bands     []Band   `json:"bands"`
+}
+
+// Band is the value given to a number up to and including Max. A band without a max takes any
+// number above the previous bands
+type Band struct {
+	Max   *int   `json:"max"`
+	Value string `json:"value"`
+}
+
+type Derivations []Derivation
+
+// loadDerivations returns the default derivations along with any defined in the file, where a
+// derivation in the file replaces a default for the same field
+func loadDerivations(file string) (Derivations, error) {
+	derivations := append(Derivations{}, defaultDerivations...)
+	if file == "" {
+		return derivations, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read derived fields file: %w", err)
+	}
+	var defined Derivations
+	if err := json.Unmarshal(data, &defined); err != nil {
+		return nil, fmt.Errorf("unable to parse derived fields file: %w", err)
+	}
+	for _, d := range defined {
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+		derivations = derivations.with(d)
+	}
+	return derivations, nil
+}
+
+// with adds the derivation, replacing any for the same field. Fields are matched whatever their
+// case, as they are when checked against the party attributes, so a field is only sent once
+func (ds Derivations) with(d Derivation) Derivations {
+	for i := range ds {
+		if strings.EqualFold(ds[i].Field, d.Field) {
+			ds[i] = d
+			return ds
+		}
+	}
+	return append(ds, d)
+}
+
+func (d Derivation) validate() error {
+	if d.Field == "" {
+		return errors.New("derived field name is required")
+	}
+	if attributeFields[strings.ToLower(d.Field)] {
+		return fmt.Errorf("derived field %s is already a party attribute", d.Field)
+	}
+	if len(d.Columns) == 0 {
+		return fmt.Errorf("derived field %s has no columns", d.Field)
+	}
+	switch d.Rule {
+	case deriveJoin, deriveFirst:
+	case deriveBand:
+		if len(d.Columns) != 1 {
+			return fmt.Errorf("derived field %s must band a single column", d.Field)
+		}
+		if len(d.Bands) == 0 {
+			return fmt.Errorf("derived field %s has no bands", d.Field)
+		}
+	default:
+		return fmt.Errorf("derived field %s rule must be one of %s, %s or %s", d.Field, deriveJoin, deriveFirst, deriveBand)
+	}
+	return nil
+}
+
+// derive computes every derived field for a row
+func (ds Derivations) derive(row Row) (map[string]string, error) {
+	derived := map[string]string{}
+	for _, d := range ds {
+		value, err := d.derive(row)
+		if err != nil {
+			return nil, err
+		}
+		derived[d.Field] = value
+	}
+	return derived, nil
+}
+
+func (d Derivation) derive(row Row) (string, error) {
+	var values []string
+	for _, column := range d.Columns {
+		if value := strings.TrimSpace(row[column]); value != "" {
+			values = append(values, value)
+		}
+	}
+	switch d.Rule {
+	case deriveFirst:
+		if len(values) == 0 {
+			return "", nil
+		}
+		return values[0], nil
+	case deriveBand:
+		if len(values) == 0 {
+			return "", nil
+		}
+		return d.band(values[0])
+	default:
+		separator := d.Separator
+		if separator == "" {
+			separator = " "
+		}
+		return strings.Join(values, separator), nil
+	}
+}
+
+func (d Derivation) band(value string) (string, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return "", fmt.Errorf("unable to derive %s: %s must be a whole number but was %q", d.Field, d.Columns[0], value)
+	}
+	for _, band := range d.Bands {
+		if band.Max == nil || n <= *band.Max {
+			return band.Value, nil
+		}
+	}
+	return "", nil
+}
+
+// attributeFields are the json names of the fixed party attributes, which a derived field can't replace
+var attributeFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Attributes{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			fields[strings.ToLower(name)] = true
+		}
+	}
+	return fields
+}()
+
+// MarshalJSON adds the derived fields after the fixed attributes, in name order
+func (a Attributes) MarshalJSON() ([]byte, error) {
+	type attributes Attributes
+	payload, err := json.Marshal(attributes(a))
+	if err != nil || len(a.derived) == 0 {
+		return payload, err
+	}
+	fields := make([]string, 0, len(a.derived))
+	for field := range a.derived {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	buf := payload[:len(payload)-1]
+	for _, field := range fields {
+		key, _ := json.Marshal(field)
+		value, _ := json.Marshal(a.derived[field])
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+		buf = append(buf, value...)
+	}
+	return append(buf, '}'), nil
+}
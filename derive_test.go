@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultNameDerivation(t *testing.T) {
+	assert := assert.New(t)
+	derivations, err := loadDerivations("")
+	assert.Nil(err)
+
+	derived, err := derivations.derive(Row{"RUNAME1": " ACME ", "RUNAME2": "", "RUNAME3": "TRADING LTD"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"name": "ACME TRADING LTD"}, derived)
+
+	derived, err = derivations.derive(Row{})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"name": ""}, derived)
+}
+
+func TestDerivationsFromFile(t *testing.T) {
+	assert := assert.New(t)
+	file := writeSchemas(t, `[
+		{"field": "name", "rule": "join", "columns": ["RUNAME1", "RUNAME2"], "separator": ", "},
+		{"field": "tradingAs", "rule": "first", "columns": ["TRADSTYLE1", "TRADSTYLE2", "TRADSTYLE3"]},
+		{"field": "sizeBand", "rule": "band", "columns": ["FROEMPMENT"], "bands": [
+			{"max": 9, "value": "micro"}, {"max": 49, "value": "small"}, {"value": "large"}
+		]}
+	]`)
+	derivations, err := loadDerivations(file)
+	assert.Nil(err)
+	assert.Len(derivations, 3)
+
+	derived, err := derivations.derive(Row{"RUNAME1": "ACME", "RUNAME2": "LTD", "TRADSTYLE2": "ACME STORES", "FROEMPMENT": "10"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"name": "ACME, LTD", "tradingAs": "ACME STORES", "sizeBand": "small"}, derived)
+
+	derived, err = derivations.derive(Row{"FROEMPMENT": "9"})
+	assert.Nil(err)
+	assert.Equal("micro", derived["sizeBand"])
+	derived, err = derivations.derive(Row{"FROEMPMENT": "5000"})
+	assert.Nil(err)
+	assert.Equal("large", derived["sizeBand"])
+	derived, err = derivations.derive(Row{})
+	assert.Nil(err)
+	assert.Equal("", derived["sizeBand"])
+
+	_, err = derivations.derive(Row{"FROEMPMENT": "lots"})
+	assert.EqualError(err, "unable to derive sizeBand: FROEMPMENT must be a whole number but was \"lots\"")
+}
+
+func TestDerivationReplacedWhateverItsCase(t *testing.T) {
+	assert := assert.New(t)
+	derivations, err := loadDerivations(writeSchemas(t, `[
+		{"field": "NAME", "rule": "first", "columns": ["RUNAME1", "RUNAME2"]},
+		{"field": "tradingAs", "rule": "first", "columns": ["TRADSTYLE1"]},
+		{"field": "TradingAs", "rule": "first", "columns": ["TRADSTYLE2"]}
+	]`))
+	assert.Nil(err)
+	assert.Len(derivations, 2)
+
+	derived, err := derivations.derive(Row{"RUNAME1": "ACME", "RUNAME2": "LTD", "TRADSTYLE1": "ACME", "TRADSTYLE2": "ACME STORES"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"NAME": "ACME", "TradingAs": "ACME STORES"}, derived)
+}
+
+func TestInvalidDerivations(t *testing.T) {
+	for rules, expected := range map[string]string{
+		`[{"rule": "join", "columns": ["RUNAME1"]}]`:                               "derived field name is required",
+		`[{"field": "runame1", "rule": "join", "columns": ["RUNAME1"]}]`:           "derived field runame1 is already a party attribute",
+		`[{"field": "size", "rule": "join"}]`:                                      "derived field size has no columns",
+		`[{"field": "size", "rule": "sum", "columns": ["FROEMPMENT"]}]`:            "derived field size rule must be one of join, first or band",
+		`[{"field": "size", "rule": "band", "columns": ["FROEMPMENT"]}]`:           "derived field size has no bands",
+		`[{"field": "size", "rule": "band", "columns": ["FROEMPMENT", "CELLNO"]}]`: "derived field size must band a single column",
+	} {
+		_, err := loadDerivations(writeSchemas(t, rules))
+		assert.EqualError(t, err, expected)
+	}
+	_, err := loadDerivations(writeSchemas(t, "not json"))
+	assert.ErrorContains(t, err, "unable to parse derived fields file")
+}
+
+func TestPartyDerivedAttributes(t *testing.T) {
+	assert := assert.New(t)
+	record := testRecord(t, Row{"RUNAME1": "OFFICE FOR", "RUNAME2": "NATIONAL STATISTICS"})
+	record.Derived = map[string]string{"tradingAs": "ONS", "name": "OFFICE FOR NATIONAL STATISTICS"}
+
+	party, err := newParty(record, "test", "1111", false).marshall()
+	assert.Nil(err)
+	assert.Contains(string(party), "\"sampleUnitId\":\"1111\",\"name\":\"OFFICE FOR NATIONAL STATISTICS\",\"tradingAs\":\"ONS\"}")
+}
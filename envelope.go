@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	encryptionAttribute = "encryption"
+	encryptionAESGCM    = "aes-256-gcm"
+)
+
+// PayloadCipher encrypts and decrypts sample lines so that they are never held in plain text
+// in the topic or the DLQ. The algorithm is given by the encryption attribute of the message,
+// and the sample summary id is authenticated alongside the data so it can't be changed
+type PayloadCipher struct {
+	aead     cipher.AEAD
+	required bool
+}
+
+func newPayloadCipher(keyFile string, required bool) (*PayloadCipher, error) {
+	if keyFile == "" {
+		return &PayloadCipher{required: required}, nil
+	}
+	key, err := readPayloadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &PayloadCipher{aead: aead, required: required}, nil
+}
+
+// readPayloadKey accepts either a raw 32 byte key or the same key base64 encoded, as a
+// kubernetes secret is usually created from the encoded form
+func readPayloadKey(keyFile string) ([]byte, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read payload key: %w", err)
+	}
+	if len(key) == 32 {
+		return key, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+	if err != nil || len(decoded) != 32 {
+		return nil, errors.New("payload key must be 32 bytes, or 32 bytes base64 encoded")
+	}
+	return decoded, nil
+}
+
+func (pc *PayloadCipher) decrypt(data []byte, attributes map[string]string) ([]byte, error) {
+	algorithm, ok := attributes[encryptionAttribute]
+	if !ok {
+		if pc.required {
+			return nil, errors.New("message is not encrypted but encryption is required")
+		}
+		return data, nil
+	}
+	if algorithm != encryptionAESGCM {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", algorithm)
+	}
+	if pc.aead == nil {
+		return nil, errors.New("message is encrypted but no payload key is configured")
+	}
+	nonceSize := pc.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("encrypted message is too short")
+	}
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := pc.aead.Open(nil, nonce, ciphertext, []byte(attributes["sample_summary_id"]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt message: %w", err)
+	}
+	return plaintext, nil
+}
+
+// encrypt returns the data sealed with a random nonce, and sets the encryption attribute so the
+// worker knows how to decrypt it. Without a key the data is returned unchanged
+func (pc *PayloadCipher) encrypt(data []byte, attributes map[string]string) ([]byte, error) {
+	if pc.aead == nil {
+		return data, nil
+	}
+	nonce := make([]byte, pc.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	attributes[encryptionAttribute] = encryptionAESGCM
+	return pc.aead.Seal(nonce, nonce, data, []byte(attributes["sample_summary_id"])), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePayloadKey(t *testing.T) string {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	path := filepath.Join(t.TempDir(), "payload-key")
+	assert.Nil(t, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	return path
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	assert := assert.New(t)
+	cipher, err := newPayloadCipher(writePayloadKey(t), false)
+	assert.Nil(err)
+
+	attributes := map[string]string{"sample_summary_id": "test"}
+	encrypted, err := cipher.encrypt([]byte(line), attributes)
+	assert.Nil(err)
+	assert.Equal(encryptionAESGCM, attributes[encryptionAttribute])
+	assert.NotContains(string(encrypted), "OFFICE FOR NATIONAL STATISTICS")
+
+	decrypted, err := cipher.decrypt(encrypted, attributes)
+	assert.Nil(err)
+	assert.Equal(line, string(decrypted))
+}
+
+func TestDecryptWithChangedSampleSummaryId(t *testing.T) {
+	assert := assert.New(t)
+	cipher, err := newPayloadCipher(writePayloadKey(t), false)
+	assert.Nil(err)
+
+	attributes := map[string]string{"sample_summary_id": "test"}
+	encrypted, err := cipher.encrypt([]byte(line), attributes)
+	assert.Nil(err)
+
+	attributes["sample_summary_id"] = "other"
+	_, err = cipher.decrypt(encrypted, attributes)
+	assert.ErrorContains(err, "unable to decrypt message")
+}
+
+func TestDecryptPlainText(t *testing.T) {
+	assert := assert.New(t)
+	cipher, err := newPayloadCipher("", false)
+	assert.Nil(err)
+
+	data, err := cipher.decrypt([]byte(line), map[string]string{})
+	assert.Nil(err)
+	assert.Equal(line, string(data))
+}
+
+func TestDecryptPlainTextWhenRequired(t *testing.T) {
+	cipher, err := newPayloadCipher(writePayloadKey(t), true)
+	assert.Nil(t, err)
+
+	_, err = cipher.decrypt([]byte(line), map[string]string{})
+	assert.ErrorContains(t, err, "encryption is required")
+}
+
+func TestDecryptUnsupportedAlgorithm(t *testing.T) {
+	cipher, err := newPayloadCipher(writePayloadKey(t), false)
+	assert.Nil(t, err)
+
+	_, err = cipher.decrypt([]byte(line), map[string]string{encryptionAttribute: "pgp"})
+	assert.ErrorContains(t, err, "unsupported encryption algorithm")
+}
+
+func TestDecryptWithoutKey(t *testing.T) {
+	cipher, err := newPayloadCipher("", false)
+	assert.Nil(t, err)
+
+	_, err = cipher.decrypt([]byte(line), map[string]string{encryptionAttribute: encryptionAESGCM})
+	assert.ErrorContains(t, err, "no payload key is configured")
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	cipher, err := newPayloadCipher(writePayloadKey(t), false)
+	assert.Nil(t, err)
+
+	_, err = cipher.decrypt([]byte("short"), map[string]string{encryptionAttribute: encryptionAESGCM})
+	assert.ErrorContains(t, err, "too short")
+}
+
+func TestInvalidPayloadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payload-key")
+	assert.Nil(t, os.WriteFile(path, []byte("too short"), 0600))
+
+	_, err := newPayloadCipher(path, false)
+	assert.ErrorContains(t, err, "payload key must be 32 bytes")
+}
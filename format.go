@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	formatAttribute    = "format"
+	delimiterAttribute = "delimiter"
+
+	formatCSV  = "csv"
+	formatJSON = "json"
+)
+
+// delimiters can be given by name as well as by character, as a tab or pipe is easy to get
+// wrong in a message attribute or environment variable
+var delimiters = map[string]string{
+	"colon": ":",
+	"comma": ",",
+	"pipe":  "|",
+	"tab":   "\t",
+}
+
+func parseDelimiter(value string) (string, error) {
+	if delimiter, ok := delimiters[strings.ToLower(value)]; ok {
+		return delimiter, nil
+	}
+	if utf8.RuneCountInString(value) != 1 {
+		return "", fmt.Errorf("unknown delimiter %q", value)
+	}
+	return value, nil
+}
+
+func parseFormat(value string) (string, error) {
+	switch format := strings.ToLower(value); format {
+	case "", formatCSV:
+		return formatCSV, nil
+	case formatJSON:
+		return formatJSON, nil
+	default:
+		return "", fmt.Errorf("unknown format %q", value)
+	}
+}
+
+// readSample reads the data of a message into a row using the format of its schema, so that
+// the sample and party are built the same way whichever format upstream sent
+func readSample(data []byte, schema *Schema) (Row, error) {
+	if schema.Format == formatJSON {
+		return readSampleJSON(data, schema)
+	}
+	return readSampleLine(data, schema)
+}
+
+// readSampleJSON reads a JSON object keyed by column name. Numbers are kept exactly as they
+// were sent and null is treated as an empty column
+func readSampleJSON(data []byte, schema *Schema) (Row, error) {
+	logger.Debug("reading json sample", zap.String("schemaVersion", schema.Version))
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		logger.Error("unable to parse sample json", zap.Error(err))
+		return nil, err
+	}
+	row := Row{}
+	for key, value := range values {
+		column := schema.field(strings.ToUpper(key))
+		switch v := value.(type) {
+		case nil:
+			row[column] = ""
+		case string:
+			row[column] = v
+		case json.Number:
+			row[column] = v.String()
+		case bool:
+			row[column] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("column %s must be a string, number or null", key)
+		}
+	}
+	logger.Debug("read sample", redactedRow("sample", row))
+	return row, nil
+}
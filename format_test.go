@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONAndCSVProduceTheSameRow(t *testing.T) {
+	assert := assert.New(t)
+	csvRow, err := readSample([]byte(line), sampleSchemaV1)
+	assert.Nil(err)
+
+	schema := *sampleSchemaV1
+	schema.Format = formatJSON
+	jsonRow, err := readSample([]byte(`{
+		"SAMPLEUNITREF": "13110000001",
+		"REGION": "WW",
+		"RUNAME1": "OFFICE FOR NATIONAL STATISTICS",
+		"FORMTYPE": "0001"
+	}`), &schema)
+	assert.Nil(err)
+
+	assert.Equal(testRecord(t, csvRow), testRecord(t, jsonRow))
+}
+
+func TestJSONColumnNamesAndValues(t *testing.T) {
+	assert := assert.New(t)
+	schema := &Schema{Version: "2", Format: formatJSON, Mapping: map[string]string{"REPORTING_NAME": "RUNAME1"}}
+
+	row, err := readSample([]byte(`{"sampleUnitRef":"111","froempment":10,"frotover":null,"reporting_name":"ACME"}`), schema)
+	assert.Nil(err)
+	assert.Equal(Row{"SAMPLEUNITREF": "111", "FROEMPMENT": "10", "FROTOVER": "", "RUNAME1": "ACME"}, row)
+}
+
+func TestJSONInvalid(t *testing.T) {
+	schema := &Schema{Version: "2", Format: formatJSON}
+	_, err := readSample([]byte(`{"SAMPLEUNITREF":`), schema)
+	assert.NotNil(t, err)
+
+	_, err = readSample([]byte(`{"SAMPLEUNITREF":{"nested":"value"}}`), schema)
+	assert.EqualError(t, err, "column SAMPLEUNITREF must be a string, number or null")
+}
+
+func TestDelimiterFromAttribute(t *testing.T) {
+	assert := assert.New(t)
+	schemas, err := loadSchemas("", "1", CSVOptions{})
+	assert.Nil(err)
+
+	for name, delimiter := range map[string]string{"comma": ",", "pipe": "|", "tab": "\t", ";": ";"} {
+		schema, err := schemas.lookup(map[string]string{delimiterAttribute: name})
+		assert.Nil(err)
+		row, err := readSample([]byte(strings.ReplaceAll(line, ":", delimiter)), schema)
+		assert.Nil(err)
+		assert.Equal("OFFICE FOR NATIONAL STATISTICS", row["RUNAME1"], name)
+		assert.Equal("0001", row["FORMTYPE"], name)
+	}
+	// the schema itself is unchanged for other messages
+	assert.Equal(":", sampleSchemaV1.Delimiter)
+}
+
+func TestFormatFromAttribute(t *testing.T) {
+	assert := assert.New(t)
+	schemas, err := loadSchemas("", "1", CSVOptions{})
+	assert.Nil(err)
+
+	schema, err := schemas.lookup(map[string]string{formatAttribute: "JSON"})
+	assert.Nil(err)
+	row, err := readSample([]byte(`{"SAMPLEUNITREF":"111"}`), schema)
+	assert.Nil(err)
+	assert.Equal("111", row["SAMPLEUNITREF"])
+	assert.Equal(formatCSV, sampleSchemaV1.Format)
+}
+
+func TestUnknownFormatAndDelimiter(t *testing.T) {
+	assert := assert.New(t)
+	schemas, err := loadSchemas("", "1", CSVOptions{})
+	assert.Nil(err)
+
+	_, err = schemas.lookup(map[string]string{formatAttribute: "xml"})
+	assert.ErrorContains(err, "unknown format \"xml\"")
+	_, err = schemas.lookup(map[string]string{delimiterAttribute: "semicolon"})
+	assert.ErrorContains(err, "delimiter must be a single character")
+}
+
+func TestSchemaFileFormat(t *testing.T) {
+	assert := assert.New(t)
+	file := writeSchemas(t, `[
+		{"version": "2", "format": "json"},
+		{"version": "3", "delimiter": "pipe", "columns": ["SAMPLEUNITREF", "FORMTYPE"]}
+	]`)
+	schemas, err := loadSchemas(file, "1", CSVOptions{})
+	assert.Nil(err)
+
+	schema, err := schemas.lookup(map[string]string{schemaVersionAttribute: "3"})
+	assert.Nil(err)
+	assert.Equal(formatCSV, schema.Format)
+	row, err := readSample([]byte("111|0002"), schema)
+	assert.Nil(err)
+	assert.Equal(Row{"SAMPLEUNITREF": "111", "FORMTYPE": "0002"}, row)
+}
+
+func TestRedactRawJSON(t *testing.T) {
+	r := newRedactor([]string{"RUNAME1"})
+	schema := &Schema{Version: "2", Format: formatJSON}
+	assert.Equal(t, `{"RUNAME1":"[REDACTED]","SAMPLEUNITREF":"111"}`, r.raw([]byte(`{"SAMPLEUNITREF":"111","RUNAME1":"ACME"}`), schema))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+)
+
+var errNotStarted = errors.New("not started")
+
+// receiveMetrics are published by expvar, keyed by subscription, e.g. sample-file.reconnects
+var receiveMetrics = expvar.NewMap("receive")
+
+// Readiness tracks whether each message source is receiving, so the worker is only reported
+// ready while every one of them is
+type Readiness struct {
+	mu      sync.Mutex
+	sources map[string]error
+}
+
+var readiness = newReadiness()
+
+func newReadiness() *Readiness {
+	return &Readiness{sources: map[string]error{}}
+}
+
+// register adds a source that isn't ready until it starts receiving
+func (r *Readiness) register(source string) {
+	r.failed(source, errNotStarted)
+}
+
+func (r *Readiness) ready(source string) {
+	r.failed(source, nil)
+}
+
+func (r *Readiness) failed(source string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sources[source] = err
+}
+
+// ServeHTTP responds 200 when every source is receiving and 503 otherwise, with the status of
+// each source, e.g. {"sample-file": "ready"}
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	status := http.StatusOK
+	if len(r.sources) == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	sources := map[string]string{}
+	for source, err := range r.sources {
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			sources[source] = err.Error()
+			continue
+		}
+		sources[source] = "ready"
+	}
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(sources)
+}
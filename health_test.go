@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	r := newReadiness()
+	ready := func() (int, string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, _ := ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "nothing is receiving yet")
+
+	r.register("sample-file")
+	r.register("business-sample-file")
+	code, body := ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"sample-file":"not started","business-sample-file":"not started"}`, body)
+
+	r.ready("sample-file")
+	r.ready("business-sample-file")
+	code, body = ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"sample-file":"ready","business-sample-file":"ready"}`, body)
+
+	r.failed("business-sample-file", errors.New("connection reset"))
+	code, body = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"sample-file":"ready","business-sample-file":"connection reset"}`, body)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	sourcePubSub = "pubsub"
+	sourceKafka  = "kafka"
+)
+
+// KafkaConfig is the topic and consumer group the worker consumes from when MESSAGE_SOURCE is kafka
+type KafkaConfig struct {
+	Brokers         []string
+	Topic           string
+	Group           string
+	DeadLetterTopic string
+	MaxAttempts     int
+	RetryBackoff    time.Duration
+}
+
+func loadKafkaConfig() KafkaConfig {
+	return KafkaConfig{
+		Brokers:         splitList(viper.GetString("KAFKA_BROKERS")),
+		Topic:           viper.GetString("KAFKA_TOPIC"),
+		Group:           viper.GetString("KAFKA_GROUP"),
+		DeadLetterTopic: viper.GetString("KAFKA_DEAD_LETTER_TOPIC"),
+		MaxAttempts:     viper.GetInt("KAFKA_MAX_ATTEMPTS"),
+		RetryBackoff:    viper.GetDuration("KAFKA_RETRY_BACKOFF"),
+	}
+}
+
+func (k KafkaConfig) validate() error {
+	var errs []error
+	if len(k.Brokers) == 0 {
+		errs = append(errs, errors.New("KAFKA_BROKERS is required"))
+	}
+	if k.Topic == "" || k.Group == "" {
+		errs = append(errs, errors.New("KAFKA_TOPIC and KAFKA_GROUP are required"))
+	}
+	// there's no redelivery policy to fall back on, so a record that can't be processed has
+	// nowhere else to go
+	if k.DeadLetterTopic == "" {
+		errs = append(errs, errors.New("KAFKA_DEAD_LETTER_TOPIC is required"))
+	}
+	if k.MaxAttempts < 1 {
+		errs = append(errs, errors.New("KAFKA_MAX_ATTEMPTS must be at least 1"))
+	}
+	if k.RetryBackoff < 0 {
+		errs = append(errs, errors.New("KAFKA_RETRY_BACKOFF must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (k KafkaConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("brokers", strings.Join(k.Brokers, ","))
+	enc.AddString("topic", k.Topic)
+	enc.AddString("group", k.Group)
+	enc.AddString("deadLetterTopic", k.DeadLetterTopic)
+	enc.AddInt("maxAttempts", k.MaxAttempts)
+	enc.AddDuration("retryBackoff", k.RetryBackoff)
+	return nil
+}
+
+// KafkaSource consumes a Kafka topic as part of a consumer group. Kafka has no nack, so a record
+// that isn't processed is retried in place up to KAFKA_MAX_ATTEMPTS times, holding up the rest of
+// its partition, and its offset is only committed once it has been processed or dead-lettered
+type KafkaSource struct {
+	client *kgo.Client
+	config KafkaConfig
+
+	mu sync.Mutex
+	// the partitions being processed, stopped when they are revoked from the worker
+	partitions map[string]map[int32]*kafkaPartition
+}
+
+// kafkaPartition is the processing of the records a poll fetched from a partition
+type kafkaPartition struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newKafkaSource(config KafkaConfig) (*KafkaSource, error) {
+	ks := &KafkaSource{config: config, partitions: map[string]map[int32]*kafkaPartition{}}
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ConsumerGroup(config.Group),
+		kgo.ConsumeTopics(config.Topic),
+		kgo.DisableAutoCommit(),
+		// rebalances aren't held up by a record that is being retried, which could take longer than
+		// the group waits before removing the worker, so a partition that moves to another worker
+		// stops being processed here instead
+		kgo.OnPartitionsRevoked(ks.revoked),
+		kgo.OnPartitionsLost(ks.revoked),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create kafka client: %w", err)
+	}
+	ks.client = client
+	logger.Info("consuming from kafka topic", zap.String("topic", config.Topic), zap.String("group", config.Group))
+	return ks, nil
+}
+
+// Receive processes the partitions of each fetch in parallel and the records of a partition in
+// order, until ctx is done
+func (ks *KafkaSource) Receive(ctx context.Context, handle func(context.Context, Message)) error {
+	defer ks.client.Close()
+	for {
+		fetches := ks.client.PollFetches(ctx)
+		if ctx.Err() != nil || fetches.IsClientClosed() {
+			return nil
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			logger.Error("error fetching from kafka", zap.String("topic", topic), zap.Int32("partition", partition), zap.Error(err))
+		})
+		var wg sync.WaitGroup
+		fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+			pctx, done := ks.processing(ctx, p.Topic, p.Partition)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer done()
+				for _, record := range p.Records {
+					if !ks.process(ctx, pctx, record, handle) {
+						return
+					}
+				}
+			}()
+		})
+		wg.Wait()
+	}
+}
+
+// processing registers a partition as being processed until done is called, returning the context
+// to process it with, which is cancelled if the partition is revoked
+func (ks *KafkaSource) processing(ctx context.Context, topic string, partition int32) (context.Context, func()) {
+	pctx, cancel := context.WithCancel(ctx)
+	p := &kafkaPartition{cancel: cancel, done: make(chan struct{})}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.partitions[topic] == nil {
+		ks.partitions[topic] = map[int32]*kafkaPartition{}
+	}
+	ks.partitions[topic][partition] = p
+	return pctx, func() {
+		ks.mu.Lock()
+		delete(ks.partitions[topic], partition)
+		ks.mu.Unlock()
+		cancel()
+		close(p.done)
+	}
+}
+
+// revoked stops processing the partitions the worker no longer owns, and waits for them to stop
+// before the group moves them, so that their records aren't processed or committed by two workers
+// at once. A record that is already settled is still committed, and the rest are fetched again
+// from the last commit by whichever worker is assigned the partition
+func (ks *KafkaSource) revoked(_ context.Context, _ *kgo.Client, revoked map[string][]int32) {
+	var stopping []*kafkaPartition
+	ks.mu.Lock()
+	for topic, partitions := range revoked {
+		for _, partition := range partitions {
+			if p, ok := ks.partitions[topic][partition]; ok {
+				p.cancel()
+				stopping = append(stopping, p)
+			}
+		}
+	}
+	ks.mu.Unlock()
+	for _, p := range stopping {
+		<-p.done
+	}
+	if len(stopping) > 0 {
+		logger.Info("kafka partitions revoked - stopped processing", zap.Any("partitions", revoked))
+	}
+}
+
+// process handles a record until it's settled, returning false if its partition was revoked or ctx
+// is done first. The record is handled with pctx, the context of its partition, but dead-lettered
+// and committed with ctx, so a record that was settled before its partition was revoked isn't
+// processed again
+func (ks *KafkaSource) process(ctx context.Context, pctx context.Context, record *kgo.Record, handle func(context.Context, Message)) bool {
+	for attempt := 1; ; attempt++ {
+		msg := newKafkaMessage(record, attempt)
+		handle(pctx, msg)
+		settled := <-msg.settled
+		if !settled.acked && settled.reason == "" && pctx.Err() != nil {
+			// the record was given up on because its partition was revoked, not because it failed
+			return false
+		}
+		if !settled.acked && settled.reason == "" && attempt >= ks.config.MaxAttempts {
+			settled.reason = fmt.Sprintf("not processed after %d attempts", attempt)
+		}
+		if settled.reason != "" {
+			settled.acked = ks.deadLetter(ctx, msg, settled.reason)
+		}
+		if settled.acked {
+			if err := ks.client.CommitRecords(ctx, record); err != nil {
+				// the record will be processed again by whichever worker next owns the partition
+				logger.Error("unable to commit kafka offset", zap.String("messageId", msg.ID()), zap.Error(err))
+			}
+			return pctx.Err() == nil
+		}
+		logger.Warn("kafka record not processed - retrying", zap.String("messageId", msg.ID()), zap.Int("attempt", attempt))
+		select {
+		case <-pctx.Done():
+			return false
+		case <-time.After(ks.config.RetryBackoff):
+		}
+	}
+}
+
+// deadLetter produces the record to the dead letter topic with the reason attached, in the same
+// way as DeadLetterPublisher
+func (ks *KafkaSource) deadLetter(ctx context.Context, msg *kafkaMessage, reason string) bool {
+	headers := append([]kgo.RecordHeader{}, msg.record.Headers...)
+	headers = append(headers,
+		kgo.RecordHeader{Key: deadLetterReasonAttribute, Value: []byte(reason)},
+		kgo.RecordHeader{Key: deadLetterMessageIdAttribute, Value: []byte(msg.ID())})
+	dead := &kgo.Record{Topic: ks.config.DeadLetterTopic, Key: msg.record.Key, Value: msg.record.Value, Headers: headers}
+	if err := ks.client.ProduceSync(ctx, dead).FirstErr(); err != nil {
+		logger.Error("error producing to dead letter topic", zap.String("messageId", msg.ID()), zap.Error(err))
+		return false
+	}
+	logger.Info("record produced to dead letter topic", zap.String("messageId", msg.ID()), zap.String("reason", reason))
+	return true
+}
+
+// consumeKafka runs the worker against the kafka topic, only using pubsub to publish results
+func consumeKafka(ctx context.Context, config *Config) error {
+	client, err := newOptionalPubSubClient(ctx, config)
+	if err != nil {
+		logger.Fatal("failed to create client", zap.Error(err))
+	}
+	if client != nil {
+		defer client.Close()
+	}
+	worker, err := newCSVWorker(ctx, config)
+	if err != nil {
+		logger.Fatal("unable to create worker", zap.Error(err))
+	}
+	if config.Preflight {
+		if err := preflight(ctx, config, client, []*CSVWorker{worker}); err != nil {
+			return fmt.Errorf("preflight checks failed: %w", err)
+		}
+	}
+	source, err := newKafkaSource(config.Kafka)
+	if err != nil {
+		logger.Fatal("unable to create kafka source", zap.Error(err))
+	}
+	logger.Info("started", zap.String("source", sourceKafka))
+	readiness.ready(sourceKafka)
+	if err := worker.receive(ctx, client, source); err != nil {
+		readiness.failed(sourceKafka, err)
+		return fmt.Errorf("error consuming from kafka: %w", err)
+	}
+	return nil
+}
+
+type kafkaSettled struct {
+	acked  bool
+	reason string
+}
+
+// kafkaMessage is an attempt at processing a record, with its headers as attributes and its key
+// as the ordering key
+type kafkaMessage struct {
+	record     *kgo.Record
+	attributes map[string]string
+	attempt    int
+	settled    chan kafkaSettled
+	once       sync.Once
+}
+
+func newKafkaMessage(record *kgo.Record, attempt int) *kafkaMessage {
+	attributes := map[string]string{}
+	for _, h := range record.Headers {
+		attributes[h.Key] = string(h.Value)
+	}
+	return &kafkaMessage{record: record, attributes: attributes, attempt: attempt, settled: make(chan kafkaSettled, 1)}
+}
+
+func (m *kafkaMessage) ID() string {
+	return fmt.Sprintf("%s/%d/%d", m.record.Topic, m.record.Partition, m.record.Offset)
+}
+
+func (m *kafkaMessage) Data() []byte                  { return m.record.Value }
+func (m *kafkaMessage) Attributes() map[string]string { return m.attributes }
+func (m *kafkaMessage) OrderingKey() string           { return string(m.record.Key) }
+func (m *kafkaMessage) DeliveryAttempt() *int         { return &m.attempt }
+func (m *kafkaMessage) Ack()                          { m.settle(kafkaSettled{acked: true}) }
+func (m *kafkaMessage) Nack()                         { m.settle(kafkaSettled{}) }
+
+// reject dead-letters the record to the kafka dead letter topic
+func (m *kafkaMessage) reject(reason string) { m.settle(kafkaSettled{reason: reason}) }
+
+func (m *kafkaMessage) settle(settled kafkaSettled) {
+	m.once.Do(func() {
+		m.settled <- settled
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func testKafka(t *testing.T) KafkaConfig {
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(2, "sample-file", "sample-file-dlq"))
+	assert.Nil(t, err)
+	t.Cleanup(cluster.Close)
+	return KafkaConfig{
+		Brokers:         cluster.ListenAddrs(),
+		Topic:           "sample-file",
+		Group:           "csv-worker",
+		DeadLetterTopic: "sample-file-dlq",
+		MaxAttempts:     2,
+		RetryBackoff:    10 * time.Millisecond,
+	}
+}
+
+func produceRecords(t *testing.T, config KafkaConfig, records ...*kgo.Record) {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.DefaultProduceTopic(config.Topic),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()))
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Nil(t, client.ProduceSync(context.Background(), records...).FirstErr())
+}
+
+func consumeDeadLetters(t *testing.T, config KafkaConfig, n int) []*kgo.Record {
+	client, err := kgo.NewClient(kgo.SeedBrokers(config.Brokers...), kgo.ConsumeTopics(config.DeadLetterTopic))
+	assert.Nil(t, err)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < n && ctx.Err() == nil {
+		records = append(records, client.PollFetches(ctx).Records()...)
+	}
+	return records
+}
+
+func sampleRecord(attributes map[string]string) *kgo.Record {
+	record := &kgo.Record{Key: []byte("test"), Value: []byte(line)}
+	for k, v := range attributes {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+	}
+	return record
+}
+
+// waitForCommit waits for the group to commit up to the offset, returning the offset committed
+func waitForCommit(source *KafkaSource, offset int64) int64 {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		committed := source.client.CommittedOffsets()[source.config.Topic][0].Offset
+		if committed >= offset || time.Now().After(deadline) {
+			return committed
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKafkaSourceCommitsProcessedRecords(t *testing.T) {
+	sampleServer := downstreamServer(http.StatusCreated)
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusCreated)
+	defer partyServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	kafka := testKafka(t)
+	produceRecords(t, kafka,
+		sampleRecord(map[string]string{"sample_summary_id": "test"}),
+		sampleRecord(map[string]string{}))
+
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+	source, err := newKafkaSource(kafka)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go worker.receive(ctx, nil, source)
+
+	deadLetters := consumeDeadLetters(t, kafka, 1)
+	assert.Equal(t, 1, len(deadLetters))
+	headers := map[string]string{}
+	for _, h := range deadLetters[0].Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	assert.Equal(t, "missing sample summary id", headers[deadLetterReasonAttribute])
+	assert.Equal(t, "sample-file/0/1", headers[deadLetterMessageIdAttribute])
+	assert.Equal(t, line, string(deadLetters[0].Value))
+	// both records are committed, the second once it has been dead-lettered
+	assert.Equal(t, int64(2), waitForCommit(source, 2))
+}
+
+func TestKafkaSourceRetriesThenDeadLetters(t *testing.T) {
+	var requests atomic.Int32
+	sampleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer sampleServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	kafka := testKafka(t)
+	produceRecords(t, kafka, sampleRecord(map[string]string{"sample_summary_id": "test"}))
+
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+	source, err := newKafkaSource(kafka)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go worker.receive(ctx, nil, source)
+
+	deadLetters := consumeDeadLetters(t, kafka, 1)
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, int64(1), waitForCommit(source, 1))
+	assert.Equal(t, int32(2), requests.Load())
+	for _, h := range deadLetters[0].Headers {
+		if h.Key == deadLetterReasonAttribute {
+			assert.Equal(t, "not processed after 2 attempts", string(h.Value))
+		}
+	}
+}
+
+func TestKafkaSourceRebalancesWhileRetrying(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the first worker can't process anything, so it retries a record from each partition
+	var failed atomic.Int32
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+	var processed atomic.Int32
+	sampleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		processed.Add(1)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{\"id\":\"1111\"}"))
+	}))
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusCreated)
+	defer partyServer.Close()
+	kafka := testKafka(t)
+	kafka.MaxAttempts = 1000
+	kafka.RetryBackoff = 20 * time.Millisecond
+	first, second := sampleRecord(map[string]string{"sample_summary_id": "test"}), sampleRecord(map[string]string{"sample_summary_id": "test"})
+	second.Partition = 1
+	produceRecords(t, kafka, first, second)
+
+	config := testConfig()
+	config.SampleService.BaseURL = failingServer.URL
+	failingWorker, err := newCSVWorker(ctx, config)
+	assert.Nil(t, err)
+	failingSource, err := newKafkaSource(kafka)
+	assert.Nil(t, err)
+	go failingWorker.receive(ctx, nil, failingSource)
+	assert.Eventually(t, func() bool { return failed.Load() > 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// a second worker joining the group is given one of the partitions without waiting for the
+	// first worker to run out of attempts
+	config = testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(t, err)
+	source, err := newKafkaSource(kafka)
+	assert.Nil(t, err)
+	go worker.receive(ctx, nil, source)
+	assert.Eventually(t, func() bool { return processed.Load() == 1 }, 20*time.Second, 10*time.Millisecond)
+
+	// the first worker is still in the group, retrying the partition it kept
+	retries := failed.Load()
+	assert.Eventually(t, func() bool { return failed.Load() > retries }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), processed.Load())
+}
+
+func TestKafkaKeyedRecordsPublishResults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+	resultsTopic, err := client.CreateTopic(ctx, "sample-results")
+	assert.Nil(t, err)
+	defer resultsTopic.Delete(ctx)
+
+	sampleServer := downstreamServer(http.StatusCreated)
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusCreated)
+	defer partyServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	config.ResultsTopic = "sample-results"
+	// every sample record is keyed, but results aren't published in order
+	kafka := testKafka(t)
+	produceRecords(t, kafka,
+		sampleRecord(map[string]string{"sample_summary_id": "test"}),
+		sampleRecord(map[string]string{"sample_summary_id": "test"}))
+
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(t, err)
+	source, err := newKafkaSource(kafka)
+	assert.Nil(t, err)
+	go worker.receive(ctx, client, source)
+
+	// the records are committed either way, but only processed ones have results
+	assert.Equal(t, int64(2), waitForCommit(source, 2))
+	assert.Equal(t, 2, len(srv.Messages()))
+}
+
+func TestKafkaMessage(t *testing.T) {
+	record := sampleRecord(map[string]string{"sample_summary_id": "test"})
+	record.Topic = "sample-file"
+	record.Offset = 7
+	msg := newKafkaMessage(record, 3)
+	assert.Equal(t, "sample-file/0/7", msg.ID())
+	assert.Equal(t, "test", msg.Attributes()["sample_summary_id"])
+	assert.Equal(t, "test", msg.OrderingKey())
+	assert.Equal(t, 3, *msg.DeliveryAttempt())
+
+	msg.reject("bad")
+	msg.Ack()
+	assert.Equal(t, kafkaSettled{reason: "bad"}, <-msg.settled)
+}
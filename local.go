@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// FileSource delivers each line of a sample file as the message `worker publish` would publish
+// for it, one at a time, so that a file can be run through the worker without Pub/Sub
+type FileSource struct {
+	path            string
+	sampleSummaryId string
+}
+
+func newFileSource(path string, sampleSummaryId string) *FileSource {
+	return &FileSource{path: path, sampleSummaryId: sampleSummaryId}
+}
+
+// Receive returns once every line has been handled, with an error listing the lines that were nacked
+func (fs *FileSource) Receive(ctx context.Context, handle func(context.Context, Message)) error {
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lines := 0
+	var failed []int
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// the scanner reuses its buffer so take a copy of each line
+		line := append([]byte(nil), scanner.Bytes()...)
+		if len(line) == 0 {
+			continue
+		}
+		msg := newMemoryMessage(fmt.Sprintf("%s:%d", filepath.Base(fs.path), n), line, map[string]string{
+			"sample_summary_id": fs.sampleSummaryId,
+		})
+		// the worker settles every message before handle returns
+		handle(ctx, msg)
+		lines++
+		if !<-msg.acked {
+			failed = append(failed, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d lines not processed, lines %v", len(failed), lines, failed)
+	}
+	return nil
+}
+
+// process runs a sample file through the worker without Pub/Sub, to try out a file or a change to
+// the configuration against the downstream services, e.g.
+//
+//	worker process -file sample.csv -sample-summary-id 1a2b3c
+func process(ctx context.Context, config *Config, args []string) {
+	flags := flag.NewFlagSet("process", flag.ExitOnError)
+	file := flags.String("file", "", "sample file to process, one sample unit per line")
+	sampleSummaryId := flags.String("sample-summary-id", "", "sample summary the file belongs to")
+	flags.Parse(args)
+	if *file == "" || *sampleSummaryId == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := newOptionalPubSubClient(ctx, config)
+	if err != nil {
+		logger.Fatal("failed to create client", zap.Error(err))
+	}
+	if client != nil {
+		defer client.Close()
+	}
+	worker, err := newCSVWorker(ctx, config)
+	if err != nil {
+		logger.Fatal("unable to create worker", zap.Error(err))
+	}
+	if err := worker.receive(ctx, client, newFileSource(*file, *sampleSummaryId)); err != nil {
+		logger.Fatal("error processing sample file", zap.Error(err))
+	}
+	logger.Info("sample file processed", zap.String("file", *file))
+}
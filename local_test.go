@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSourceProcessesEachLine(t *testing.T) {
+	sampleServer := downstreamServer(http.StatusCreated)
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusCreated)
+	defer partyServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+
+	err = worker.receive(context.Background(), nil, newFileSource(writeSampleFile(t, 3), "test"))
+	assert.Nil(t, err)
+}
+
+func TestFileSourceReportsFailedLines(t *testing.T) {
+	sampleServer := downstreamServer(http.StatusCreated)
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusCreated)
+	defer partyServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+
+	file := filepath.Join(t.TempDir(), "sample.csv")
+	assert.Nil(t, os.WriteFile(file, []byte(line+"\n\n13110000001:::WW\n"+line+"\n"), 0600))
+	err = worker.receive(context.Background(), nil, newFileSource(file, "test"))
+	assert.EqualError(t, err, "1 of 3 lines not processed, lines [3]")
+}
+
+func TestFileSourceMissingFile(t *testing.T) {
+	source := newFileSource(filepath.Join(t.TempDir(), "missing.csv"), "test")
+	err := source.Receive(context.Background(), func(ctx context.Context, msg Message) {})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -4,21 +4,78 @@ import (
 	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/blendle/zapdriver"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var logger *zap.Logger
 
-type CSVWorker struct{}
+type CSVWorker struct {
+	config        *Config
+	sampleService *ServiceClient
+	partyService  *ServiceClient
+	cipher        *PayloadCipher
+	schemas       *Schemas
+	transforms    Transforms
+	derivations   Derivations
+}
 
-func configureLogging() {
-	var err error
-	verbose := viper.GetBool("VERBOSE")
+func newCSVWorker(ctx context.Context, config *Config) (*CSVWorker, error) {
+	return newSharedCSVWorker(ctx, config, serviceClients{})
+}
+
+// newSharedCSVWorker creates a worker that takes its downstream clients from services, so workers
+// calling the same service share its connections and rate limit
+func newSharedCSVWorker(ctx context.Context, config *Config, services serviceClients) (*CSVWorker, error) {
+	sampleService, err := services.get(ctx, config.SampleService, config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	partyService, err := services.get(ctx, config.PartyService, config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := newPayloadCipher(config.PayloadKeyFile, config.PayloadEncryptionRequired)
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := loadSchemas(config.SchemasFile, config.DefaultSchemaVersion, config.CSV)
+	if err != nil {
+		return nil, err
+	}
+	transforms, err := loadTransforms(config.TransformsFile)
+	if err != nil {
+		return nil, err
+	}
+	derivations, err := loadDerivations(config.DerivedFieldsFile)
+	if err != nil {
+		return nil, err
+	}
+	return &CSVWorker{
+		config:        config,
+		sampleService: sampleService,
+		partyService:  partyService,
+		cipher:        cipher,
+		schemas:       schemas,
+		transforms:    transforms,
+		derivations:   derivations,
+	}, nil
+}
 
+func configureLogging(verbose bool) {
+	var err error
 	if verbose {
 		config := zapdriver.NewProductionConfig()
 		config.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
@@ -36,117 +93,361 @@ func configureLogging() {
 	}
 }
 
-func (cw CSVWorker) start() {
-	logger.Debug("starting worker process")
-	ctx := context.Background()
-	client, err := pubsub.NewClient(ctx, viper.GetString("GOOGLE_CLOUD_PROJECT"))
-	if err != nil {
-		logger.Fatal("failed to create client", zap.Error(err))
-	}
-	defer client.Close()
-	logger.Debug("about to subscribe")
-	cw.subscribe(ctx, client)
-}
-
-func (cw CSVWorker) subscribe(ctx context.Context, client *pubsub.Client) {
-	subId := viper.GetString("PUBSUB_SUB_ID")
+// subscribe receives from the subscription until ctx is done, reconnecting with backoff when
+// receiving fails. It only gives up on an error that reconnecting can't fix, such as the
+// subscription not existing
+func (cw CSVWorker) subscribe(ctx context.Context, client *pubsub.Client) error {
+	subId := cw.config.SubscriptionID
 	logger.Info("subscribing to subscription", zap.String("subId", subId))
 	sub := client.Subscription(subId)
-	cctx, cancel := context.WithCancel(ctx)
-	logger.Debug("waiting to receive")
-	err := sub.Receive(cctx, func(ctx context.Context, msg *pubsub.Message) {
-		logger.Info("sample received - processing", zap.String("messageId", msg.ID))
-		logger.Debug("sample data", zap.String("data", string(msg.Data)))
+	// keep extending the ack deadline while a message waits on a downstream rate limit
+	sub.ReceiveSettings.MaxExtension = cw.config.MaxExtension
+	sub.ReceiveSettings.MaxOutstandingMessages = cw.config.MaxOutstandingMessages
+	sub.ReceiveSettings.NumGoroutines = cw.config.NumGoroutines
+	cw.checkOrdering(ctx, sub)
+	return cw.receiveReconnecting(ctx, client, newPubSubSource(sub))
+}
 
-		if msg.DeliveryAttempt != nil {
-			logger.Info("Message delivery attempted", zap.Int("delivery attempts", *msg.DeliveryAttempt))
+// receiveReconnecting receives from the source again each time it fails, until ctx is done or it
+// fails with an error that means it never will succeed
+func (cw CSVWorker) receiveReconnecting(ctx context.Context, client *pubsub.Client, source MessageSource) error {
+	subId := cw.config.SubscriptionID
+	backoff := cw.config.ReceiveBackoff
+	for {
+		logger.Debug("waiting to receive")
+		started := time.Now()
+		err := cw.receive(ctx, client, readyOnceReceiving(source, cw.config.ReceiveReadyAfter, func() {
+			readiness.ready(subId)
+		}))
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			err = errors.New("receive stopped unexpectedly")
+		}
+		readiness.failed(subId, err)
+		if fatalReceiveError(err) {
+			logger.Error("unable to receive from subscription - giving up", zap.String("subId", subId), zap.Error(err))
+			return fmt.Errorf("subscription %s: %w", subId, err)
+		}
+		// a connection that has been up for a while starts backing off again from the beginning
+		if time.Since(started) > cw.config.ReceiveMaxBackoff {
+			backoff = cw.config.ReceiveBackoff
 		}
+		logger.Warn("error receiving from subscription - reconnecting",
+			zap.String("subId", subId),
+			zap.Error(err),
+			zap.Duration("backoff", backoff))
+		receiveMetrics.Add(subId+".reconnects", 1)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, cw.config.ReceiveMaxBackoff)
+	}
+}
 
-		data := msg.Data
-		attribute := msg.Attributes
-		sampleSummaryId, ok := attribute["sample_summary_id"]
-		if ok {
-			logger.Info("about to process sample", zap.String("sampleSummaryId", sampleSummaryId))
-			line, err := readSampleLine(data)
-			if err != nil {
-				logger.Error("error processing line in sample - nacking message", zap.Error(err))
-				//after x number of nacks message will be DLQ
-				msg.Nack()
-			} else {
-				sampleUnitId, err := processSample(line, sampleSummaryId, msg)
-				if err != nil {
-					logger.Warn("error processing sample - nacking message",
-						zap.Error(err),
-						zap.String("sampleUnitId", sampleUnitId))
-					//after x number of nacks message will be DLQ
-					msg.Nack()
-				} else {
-					//now the sample has been created, lets create the associated party
-					err := processParty(line, sampleSummaryId, sampleUnitId, msg)
-					if err != nil {
-						logger.Warn("error processing party - nacking message",
-							zap.Error(err),
-							zap.String("sampleUnitId", sampleUnitId))
-						//after x number of nacks message will be DLQ
-						msg.Nack()
-					}
-					logger.Info("sample processed - acking message")
-					msg.Ack()
-				}
-			}
-		} else {
-			logger.Error("missing sample summary id - sending to DLQ")
+// readyOnceReceiving calls ready once the source has received a message or kept receiving for
+// PUBSUB_RECEIVE_READY_AFTER, so a source that fails as soon as it connects is never reported
+// ready. ready isn't called after Receive returns
+func readyOnceReceiving(source MessageSource, after time.Duration, ready func()) MessageSource {
+	return receiveFunc(func(ctx context.Context, handle func(context.Context, Message)) error {
+		var once sync.Once
+		timer := time.AfterFunc(after, func() { once.Do(ready) })
+		defer func() {
+			timer.Stop()
+			// waits for a ready that is already being called
+			once.Do(func() {})
+		}()
+		return source.Receive(ctx, func(ctx context.Context, msg Message) {
+			once.Do(ready)
+			handle(ctx, msg)
+		})
+	})
+}
+
+// receiveFunc is a MessageSource that receives by calling the function
+type receiveFunc func(ctx context.Context, handle func(context.Context, Message)) error
+
+func (f receiveFunc) Receive(ctx context.Context, handle func(context.Context, Message)) error {
+	return f(ctx, handle)
+}
+
+// fatalReceiveError is true for errors that mean the subscription can't be received from
+// however many times the worker reconnects, like a missing subscription or permission
+func fatalReceiveError(err error) bool {
+	switch status.Code(err) {
+	case codes.NotFound, codes.PermissionDenied, codes.Unauthenticated, codes.InvalidArgument:
+		return true
+	}
+	return false
+}
+
+// receive processes the messages from a source until ctx is done or the source fails, using the
+// client to publish results and dead letters
+func (cw CSVWorker) receive(ctx context.Context, client *pubsub.Client, source MessageSource) error {
+	results := newResultPublisher(client, cw.config.ResultsTopic, cw.config.Ordering.enabled())
+	defer results.stop()
+	deadLetters := newDeadLetterPublisher(client, cw.config.DeadLetterTopic)
+	defer deadLetters.stop()
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return source.Receive(cctx, recoverPanics(deadLetters, func(ctx context.Context, msg Message) {
+		// the downstream requests for the message are cancelled along with ctx, when the worker is
+		// shutting down or the source stops waiting for the message
+		switch outcome, reason := cw.processWithDeadline(withTraceParent(ctx, msg), msg, results); outcome {
+		case outcomeAck:
+			msg.Ack()
+		case outcomeDeadLetter:
+			deadLetters.deadLetter(ctx, msg, reason)
+		default:
+			//after x number of nacks message will be DLQ
 			msg.Nack()
 		}
-	})
+	}))
+}
+
+// processWithDeadline gives up on the downstream requests for a message once it has been processing
+// for MESSAGE_DEADLINE, so it is nacked before pubsub stops extending its ack deadline and
+// redelivers it to another worker
+func (cw CSVWorker) processWithDeadline(ctx context.Context, msg Message, results *ResultPublisher) (outcome, string) {
+	dctx, cancel := context.WithTimeout(ctx, cw.config.MessageDeadline)
+	defer cancel()
+	outcome, reason := cw.process(dctx, msg, results)
+	if outcome == outcomeNack && errors.Is(dctx.Err(), context.DeadlineExceeded) {
+		logger.Warn("message deadline exceeded - nacking message",
+			zap.String("messageId", msg.ID()),
+			zap.Duration("deadline", cw.config.MessageDeadline))
+		receiveMetrics.Add(cw.config.SubscriptionID+".deadlinesExceeded", 1)
+	}
+	return outcome, reason
+}
+
+// outcome is what should become of a message once the worker has tried to process it
+type outcome int
 
+const (
+	outcomeAck outcome = iota
+	outcomeNack
+	outcomeDeadLetter
+)
+
+// process runs a message through the pipeline, returning the reason alongside a message that
+// should be dead-lettered
+func (cw CSVWorker) process(ctx context.Context, msg Message, results *ResultPublisher) (outcome, string) {
+	logger.Info("sample received - processing", zap.String("messageId", msg.ID()), zap.String("orderingKey", msg.OrderingKey()))
+
+	if msg.DeliveryAttempt() != nil {
+		logger.Info("Message delivery attempted", zap.Int("delivery attempts", *msg.DeliveryAttempt()))
+	}
+
+	attribute := msg.Attributes()
+	sampleSummaryId, ok := attribute["sample_summary_id"]
+	if !ok {
+		return outcomeDeadLetter, "missing sample summary id"
+	}
+	logger.Info("about to process sample", zap.String("sampleSummaryId", sampleSummaryId))
+	schema, err := cw.schemas.lookup(attribute)
+	if err != nil {
+		return outcomeDeadLetter, err.Error()
+	}
+	data, err := cw.cipher.decrypt(msg.Data(), attribute)
+	if err != nil {
+		return outcomeDeadLetter, err.Error()
+	}
+	logger.Debug("sample data", redactedRaw("data", data, schema))
+	row, err := readSample(data, schema)
+	if err != nil {
+		return outcomeDeadLetter, "unable to parse sample: " + err.Error()
+	}
+	row = cw.transforms.apply(row)
+	record, err := newRecord(row, cw.config.BirthDateFormat)
+	if err != nil {
+		return outcomeDeadLetter, "invalid sample: " + err.Error()
+	}
+	record.Derived, err = cw.derivations.derive(row)
 	if err != nil {
-		logger.Error("error subscribing")
-		cancel()
+		return outcomeDeadLetter, "invalid sample: " + err.Error()
 	}
+	sampleUnitId, err := processSample(ctx, cw.sampleService, record, sampleSummaryId, msg.ID())
+	if err != nil {
+		logger.Warn("error processing sample - nacking message",
+			zap.Error(err),
+			zap.String("sampleUnitId", sampleUnitId),
+			zap.String("orderingKey", msg.OrderingKey()))
+		return outcomeNack, ""
+	}
+	//now the sample has been created, lets create the associated party
+	partyOutcome, err := processParty(ctx, cw.partyService, record, sampleSummaryId, sampleUnitId, msg.ID())
+	if err != nil {
+		logger.Warn("error processing party - nacking message",
+			zap.Error(err),
+			zap.String("sampleUnitId", sampleUnitId),
+			zap.String("orderingKey", msg.OrderingKey()))
+		return outcomeNack, ""
+	}
+	result := newResult(record.SAMPLEUNITREF, sampleSummaryId, sampleUnitId, partyOutcome)
+	err = results.publish(ctx, result, msg.OrderingKey())
+	if err != nil {
+		logger.Warn("error publishing result - nacking message",
+			zap.Error(err),
+			zap.String("sampleUnitId", sampleUnitId),
+			zap.String("orderingKey", msg.OrderingKey()))
+		return outcomeNack, ""
+	}
+	logger.Info("sample processed - acking message")
+	return outcomeAck, ""
 }
 
-func readSampleLine(line []byte) ([]string, error) {
-	logger.Debug("reading csv line")
+// checkOrdering warns when the subscription doesn't match the ordering the worker expects, as
+// pubsub doesn't say when ordering keys are being ignored
+func (cw CSVWorker) checkOrdering(ctx context.Context, sub *pubsub.Subscription) {
+	config, err := sub.Config(ctx)
+	if err != nil {
+		logger.Warn("unable to check subscription ordering", zap.Error(err))
+		return
+	}
+	if config.EnableMessageOrdering != cw.config.Ordering.enabled() {
+		logger.Warn("subscription message ordering doesn't match ORDERING_KEY",
+			zap.String("subId", sub.ID()),
+			zap.Bool("subscriptionOrdered", config.EnableMessageOrdering),
+			zap.String("orderingKey", cw.config.Ordering.Mode))
+	}
+}
+
+func readSampleLine(line []byte, schema *Schema) (Row, error) {
+	logger.Debug("reading csv line", zap.String("schemaVersion", schema.Version))
+	line, err := schema.CSV.decode(line)
+	if err != nil {
+		logger.Error("unable to decode sample csv", zap.Error(err))
+		return nil, err
+	}
 	r := csv.NewReader(bytes.NewReader(line))
-	r.Comma = ':'
+	r.Comma = schema.comma()
+	r.LazyQuotes = schema.CSV.LazyQuotes
+	r.TrimLeadingSpace = schema.CSV.NormaliseSpace
+	// the field count is checked against the schema below, so the error can name the column
+	r.FieldsPerRecord = -1
 
 	sample, err := r.Read()
 	if err != nil {
 		logger.Error("unable to parse sample csv", zap.Error(err))
 		return nil, err
 	}
-	logger.Debug("read sample", zap.Strings("sample", sample))
-	return sample, nil
+	if err := schema.CSV.check(sample, schema.Columns); err != nil {
+		logger.Error("invalid sample csv", zap.Error(err))
+		return nil, err
+	}
+	schema.CSV.normalise(sample)
+	row := schema.row(sample)
+	logger.Debug("read sample", redactedRow("sample", row))
+	return row, nil
 }
 
-func setDefaults() {
-	viper.SetDefault("PUBSUB_SUB_ID", "sample-file")
-	viper.SetDefault("PUB_SUB_TOPIC", "sample-file")
-	viper.SetDefault("GOOGLE_CLOUD_PROJECT", "rm-ras-sandbox")
-	viper.SetDefault("VERBOSE", true)
-	viper.SetDefault("SAMPLE_SERVICE_BASE_URL", "http://localhost:8080")
-	viper.SetDefault("PARTY_SERVICE_BASE_URL", "http://localhost:8080")
-	viper.SetDefault("SECURITY_USER_NAME", "admin")
-	viper.SetDefault("SECURITY_USER_PASSWORD", "secret")
+// work receives until ctx is done, a subscription fails in a way the worker can't recover from,
+// or the push server stops
+func work(ctx context.Context, config *Config) error {
+	if err := config.Credentials.watch(); err != nil {
+		logger.Fatal("unable to watch security credentials", zap.Error(err))
+	}
+	defer config.Credentials.close()
+	serveMetrics(config.MetricsAddr)
+	if config.Source == sourceKafka {
+		return consumeKafka(ctx, config)
+	}
+	client, err := pubsub.NewClient(ctx, config.ProjectID)
+	if err != nil {
+		logger.Fatal("failed to create client", zap.Error(err))
+	}
+	defer client.Close()
+
+	workers, err := newCSVWorkers(ctx, config)
+	if err != nil {
+		logger.Fatal("unable to create worker", zap.Error(err))
+	}
+	if config.Preflight {
+		if err := preflight(ctx, config, client, workers); err != nil {
+			return fmt.Errorf("preflight checks failed: %w", err)
+		}
+	}
+	if config.PushAddr != "" {
+		sources := map[string]*PushSource{}
+		for _, csvWorker := range workers {
+			source := newPushSource()
+			sources[csvWorker.config.SubscriptionID] = source
+			go csvWorker.receive(ctx, client, source)
+			readiness.ready(csvWorker.config.SubscriptionID)
+		}
+		return servePush(ctx, config.PushAddr, newPushHandler(sources, config))
+	}
+	// the workers share the one client, and all stop when one of them fails
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(workers))
+	var wg sync.WaitGroup
+	for i, csvWorker := range workers {
+		readiness.register(csvWorker.config.SubscriptionID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = csvWorker.subscribe(cctx, client); errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	logger.Info("started", zap.Int("subscriptions", len(workers)))
+	wg.Wait()
+	return errors.Join(errs...)
 }
 
-func work() {
-	csvWorker := &CSVWorker{}
-	logger.Info("started")
-	csvWorker.start()
+// newOptionalPubSubClient creates a client for a worker that doesn't receive from pubsub, which
+// only needs one to publish results and dead letters
+func newOptionalPubSubClient(ctx context.Context, config *Config) (*pubsub.Client, error) {
+	if config.ResultsTopic == "" && config.DeadLetterTopic == "" {
+		return nil, nil
+	}
+	return pubsub.NewClient(ctx, config.ProjectID)
 }
 
-func configure() {
+func configure() *Config {
 	//config
 	viper.AutomaticEnv()
 	setDefaults()
-	configureLogging()
+	configureLogging(viper.GetBool("VERBOSE"))
+	config, err := loadConfig()
+	if err != nil {
+		logger.Fatal("unable to load configuration", zap.Error(err))
+	}
+	if err := config.validate(); err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	configureRedaction(config.RedactFields)
+	logger.Info("loaded configuration", zap.Object("config", config))
+	return config
 }
 
 func main() {
-	configure()
+	config := configure()
+	// kubernetes sends SIGTERM to stop the pod, which cancels the requests in flight so their
+	// messages are nacked and redelivered straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(os.Args) > 1 && os.Args[1] == "publish" {
+		publish(ctx, config, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "process" {
+		process(ctx, config, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		check(ctx, config)
+		return
+	}
 	logger.Info("starting")
-	work()
+	if err := work(ctx, config); err != nil {
+		logger.Fatal("worker stopped", zap.Error(err))
+	}
 	logger.Info("exiting")
 }
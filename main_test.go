@@ -4,20 +4,32 @@ import (
 	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/pubsub/pstest"
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 var line = "13110000001:::::::::::WW:::::OFFICE FOR NATIONAL STATISTICS:::::::::0001:"
 
+func TestMain(m *testing.M) {
+	// most of the worker logs as it goes, so the logger must exist whichever test runs first
+	configureLogging(true)
+	os.Exit(m.Run())
+}
+
 func TestSubscribe(t *testing.T) {
 
 	//create a fake Pub Sub serer
@@ -34,7 +46,8 @@ func TestSubscribe(t *testing.T) {
 	defer client.Close()
 
 	assert := assert.New(t)
-	configure()
+	configureLogging(true)
+	config := testConfig()
 
 	topic, err := createTopic(client, ctx, assert)
 	defer topic.Delete(ctx)
@@ -61,10 +74,9 @@ func TestSubscribe(t *testing.T) {
 	defer partyServer.Close()
 
 	fmt.Printf("Setting sample url %s", sampleServer.URL)
-	err = os.Setenv("SAMPLE_SERVICE_BASE_URL", sampleServer.URL)
+	config.SampleService.BaseURL = sampleServer.URL
 	fmt.Printf("Setting party url %s", partyServer.URL)
-	err = os.Setenv("PARTY_SERVICE_BASE_URL", partyServer.URL)
-	assert.Nil(err)
+	config.PartyService.BaseURL = partyServer.URL
 
 	msg := &pubsub.Message{
 		Data: []byte(line),
@@ -78,8 +90,9 @@ func TestSubscribe(t *testing.T) {
 	assert.Nil(err)
 	fmt.Println(id)
 
-	worker := CSVWorker{}
-	go worker.subscribe(ctx, client)
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(err)
+	subscribeUntilCleanup(t, worker, client)
 
 	//sleep a second for the test to complete, then allow everything to shut down
 	time.Sleep(1 * time.Second)
@@ -93,13 +106,37 @@ func TestSubscribe(t *testing.T) {
 }
 
 func parseSample(err error, assert *assert.Assertions) []byte {
-	sample, err := readSampleLine([]byte(line))
-	s := create(sample)
+	sample, err := readSampleLine([]byte(line), sampleSchemaV1)
+	assert.Nil(err)
+	record, err := newRecord(sample, birthDateLayout)
+	assert.Nil(err)
+	s := create(record, false)
 	sampleJson, err := s.marshall()
 	assert.Nil(err)
 	return sampleJson
 }
 
+func testRecord(t *testing.T, row Row) *Record {
+	record, err := newRecord(row, birthDateLayout)
+	assert.Nil(t, err)
+	return record
+}
+
+// subscribeUntilCleanup runs the worker's subscriber until the test has finished, so that it
+// isn't left reconnecting to a closed fake server while other tests run
+func subscribeUntilCleanup(t *testing.T, worker *CSVWorker, client *pubsub.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		worker.subscribe(ctx, client)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
 func createSubscription(client *pubsub.Client, ctx context.Context, err error, topic *pubsub.Topic, assert *assert.Assertions) *pubsub.Subscription {
 	sub, err := client.CreateSubscription(ctx, "sample-file", pubsub.SubscriptionConfig{
 		Topic: topic,
@@ -150,9 +187,10 @@ func TestNoAckAsSampleSummaryIdMissing(t *testing.T) {
 	assert.Nil(err)
 	fmt.Println(id)
 
-	worker := CSVWorker{}
-	configure()
-	go worker.subscribe(ctx, client)
+	configureLogging(true)
+	worker, err := newCSVWorker(ctx, testConfig())
+	assert.Nil(err)
+	subscribeUntilCleanup(t, worker, client)
 
 	//sleep a second for the test to complete, then allow everything to shut down
 	time.Sleep(1 * time.Second)
@@ -164,3 +202,218 @@ func TestNoAckAsSampleSummaryIdMissing(t *testing.T) {
 	//and check it hasn't been ack
 	assert.Equal(0, messages[0].Acks)
 }
+
+func testConfig() *Config {
+	return &Config{
+		ProjectID:       "rm-ras-sandbox",
+		SubscriptionID:  "sample-file",
+		Topic:           "sample-file",
+		Verbose:         true,
+		MaxExtension:    60 * time.Minute,
+		MessageDeadline: 10 * time.Minute,
+
+		ReceiveBackoff:    time.Second,
+		ReceiveMaxBackoff: time.Minute,
+		ReceiveReadyAfter: 10 * time.Second,
+
+		MaxOutstandingMessages: 1000,
+		NumGoroutines:          10,
+		Subscriptions:          []Subscription{{ID: "sample-file"}},
+
+		SampleService: DownstreamConfig{
+			Name:            "sample",
+			BaseURL:         "http://localhost:8080",
+			Timeout:         30 * time.Second,
+			IdleConnTimeout: 1500 * time.Millisecond,
+			Auth:            authNone,
+			EmptyFields:     emptyFieldsNull,
+		},
+		PartyService: DownstreamConfig{
+			Name:            "party",
+			BaseURL:         "http://localhost:8080",
+			Timeout:         30 * time.Second,
+			IdleConnTimeout: 1500 * time.Millisecond,
+			Auth:            authBasic,
+			EmptyFields:     emptyFieldsNull,
+		},
+		Credentials:          newStaticCredentials("admin", "secret"),
+		DefaultSchemaVersion: sampleSchemaV1.Version,
+		BirthDateFormat:      birthDateLayout,
+		Ordering:             Ordering{Mode: orderingNone},
+		Source:               sourcePubSub,
+	}
+}
+
+func testServiceClient(baseUrl string) *ServiceClient {
+	config := testConfig()
+	config.PartyService.BaseURL = baseUrl
+	service, _ := newServiceClient(context.Background(), config.PartyService, config.Credentials)
+	return service
+}
+
+func TestSubscribeMissingSubscriptionIsFatal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	config := testConfig()
+	config.SubscriptionID = "missing"
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(t, err)
+	err = worker.subscribe(ctx, client)
+	assert.True(t, fatalReceiveError(err))
+	assert.ErrorContains(t, err, "subscription missing")
+	assert.Nil(t, ctx.Err(), "should give up without waiting to be cancelled")
+
+	w := httptest.NewRecorder()
+	readiness.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "missing")
+}
+
+// failingSource fails to receive the given number of times and then receives until ctx is done.
+// It notes whether the subscription was reported ready while it was failing
+type failingSource struct {
+	failures       atomic.Int32
+	err            error
+	subId          string
+	readyOnFailure atomic.Bool
+}
+
+func (fs *failingSource) Receive(ctx context.Context, handle func(context.Context, Message)) error {
+	if fs.failures.Add(-1) >= 0 {
+		if readyStatus(fs.subId) == "ready" {
+			fs.readyOnFailure.Store(true)
+		}
+		return fs.err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// readyStatus is what /ready reports for a subscription
+func readyStatus(subId string) string {
+	w := httptest.NewRecorder()
+	readiness.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var sources map[string]string
+	json.NewDecoder(w.Body).Decode(&sources)
+	return sources[subId]
+}
+
+func TestReceiveReconnectsAfterTransientError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := testConfig()
+	config.SubscriptionID = "transient"
+	config.ReceiveBackoff = 10 * time.Millisecond
+	config.ReceiveMaxBackoff = 20 * time.Millisecond
+	config.ReceiveReadyAfter = 100 * time.Millisecond
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(t, err)
+	source := &failingSource{err: status.Error(codes.Unavailable, "stream broken"), subId: "transient"}
+	source.failures.Store(3)
+	reconnects := metric(receiveMetrics, "transient.reconnects")
+	readiness.register("transient")
+	done := make(chan error)
+	go func() {
+		done <- worker.receiveReconnecting(ctx, nil, source)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return metric(receiveMetrics, "transient.reconnects")-reconnects == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, source.readyOnFailure.Load(), "should not be ready while it keeps failing")
+	// ready once it has been receiving for a while
+	assert.Eventually(t, func() bool { return readyStatus("transient") == "ready" }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Nil(t, <-done, "a transient error should not stop the worker")
+}
+
+func TestReceiveReadyOnFirstMessage(t *testing.T) {
+	config := testConfig()
+	config.SubscriptionID = "first-message"
+	config.ReceiveReadyAfter = time.Hour
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+	source := newChannelSource(1)
+	readiness.register("first-message")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- worker.receiveReconnecting(ctx, nil, source)
+	}()
+
+	assert.Equal(t, errNotStarted.Error(), readyStatus("first-message"))
+	msg := newMemoryMessage("1", []byte(line), map[string]string{})
+	source.send(msg)
+	<-msg.acked
+	assert.Equal(t, "ready", readyStatus("first-message"))
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestReceiveGivesUpAfterFatalError(t *testing.T) {
+	config := testConfig()
+	config.SubscriptionID = "fatal"
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+	source := &failingSource{err: status.Error(codes.PermissionDenied, "denied")}
+	source.failures.Store(1)
+
+	err = worker.receiveReconnecting(context.Background(), nil, source)
+	assert.ErrorContains(t, err, "subscription fatal")
+	assert.True(t, fatalReceiveError(err))
+}
+
+func TestFatalReceiveError(t *testing.T) {
+	assert.True(t, fatalReceiveError(status.Error(codes.NotFound, "subscription not found")))
+	assert.True(t, fatalReceiveError(fmt.Errorf("subscription sample-file: %w", status.Error(codes.PermissionDenied, "denied"))))
+	assert.False(t, fatalReceiveError(status.Error(codes.Unavailable, "try again")))
+	assert.False(t, fatalReceiveError(errors.New("receive stopped unexpectedly")))
+}
+
+// blockingServer never responds, reporting each request that is cancelled while it waits
+func blockingServer() (*httptest.Server, chan struct{}) {
+	cancelled := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client going away once the body has been read
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	return server, cancelled
+}
+
+func TestMessageDeadlineCancelsDownstreamRequests(t *testing.T) {
+	sampleServer, cancelled := blockingServer()
+	defer sampleServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.MessageDeadline = 100 * time.Millisecond
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+
+	msg := newMemoryMessage("1", []byte(line), map[string]string{"sample_summary_id": "test"})
+	source := newChannelSource(1)
+	source.send(msg)
+	source.close()
+
+	start := time.Now()
+	err = worker.receive(context.Background(), nil, source)
+	assert.Nil(t, err)
+	assert.False(t, <-msg.acked)
+	assert.Less(t, time.Since(start), config.SampleService.Timeout, "should give up at the message deadline, not the request timeout")
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sample service request was not cancelled")
+	}
+	deadlines, ok := receiveMetrics.Get("sample-file.deadlinesExceeded").(*expvar.Int)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, deadlines.Value(), int64(1))
+}
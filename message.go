@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Message is a sample unit received from a MessageSource, which is acked once it has been
+// processed or nacked to be delivered again
+type Message interface {
+	ID() string
+	Data() []byte
+	Attributes() map[string]string
+	OrderingKey() string
+	DeliveryAttempt() *int
+	Ack()
+	Nack()
+}
+
+// MessageSource delivers messages to the worker, so that processing doesn't depend on where the
+// messages come from. Receive calls handle for each message until ctx is done or the source fails
+type MessageSource interface {
+	Receive(ctx context.Context, handle func(context.Context, Message)) error
+}
+
+// rejecter is implemented by messages whose source distinguishes a message that can never be
+// processed from one to retry, where there's no dead letter topic to hand it to
+type rejecter interface {
+	reject(reason string)
+}
+
+// PubSubSource receives messages from a Pub/Sub pull subscription
+type PubSubSource struct {
+	sub *pubsub.Subscription
+}
+
+func newPubSubSource(sub *pubsub.Subscription) *PubSubSource {
+	return &PubSubSource{sub: sub}
+}
+
+func (ps *PubSubSource) Receive(ctx context.Context, handle func(context.Context, Message)) error {
+	return ps.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		handle(ctx, pubsubMessage{msg})
+	})
+}
+
+type pubsubMessage struct {
+	msg *pubsub.Message
+}
+
+func (m pubsubMessage) ID() string                    { return m.msg.ID }
+func (m pubsubMessage) Data() []byte                  { return m.msg.Data }
+func (m pubsubMessage) Attributes() map[string]string { return m.msg.Attributes }
+func (m pubsubMessage) OrderingKey() string           { return m.msg.OrderingKey }
+func (m pubsubMessage) DeliveryAttempt() *int         { return m.msg.DeliveryAttempt }
+func (m pubsubMessage) Ack()                          { m.msg.Ack() }
+func (m pubsubMessage) Nack()                         { m.msg.Nack() }
+
+// ChannelSource delivers the messages sent on a channel one at a time, until the channel is closed
+type ChannelSource struct {
+	messages chan Message
+}
+
+func newChannelSource(size int) *ChannelSource {
+	return &ChannelSource{messages: make(chan Message, size)}
+}
+
+func (cs *ChannelSource) send(msg Message) {
+	cs.messages <- msg
+}
+
+func (cs *ChannelSource) close() {
+	close(cs.messages)
+}
+
+func (cs *ChannelSource) Receive(ctx context.Context, handle func(context.Context, Message)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-cs.messages:
+			if !ok {
+				return nil
+			}
+			handle(ctx, msg)
+		}
+	}
+}
+
+// memoryMessage is a message held in memory, which reports on acked whether it was acked once it
+// has been settled
+type memoryMessage struct {
+	id          string
+	data        []byte
+	attributes  map[string]string
+	orderingKey string
+	acked       chan bool
+	once        sync.Once
+}
+
+func newMemoryMessage(id string, data []byte, attributes map[string]string) *memoryMessage {
+	return &memoryMessage{id: id, data: data, attributes: attributes, acked: make(chan bool, 1)}
+}
+
+func (m *memoryMessage) ID() string                    { return m.id }
+func (m *memoryMessage) Data() []byte                  { return m.data }
+func (m *memoryMessage) Attributes() map[string]string { return m.attributes }
+func (m *memoryMessage) OrderingKey() string           { return m.orderingKey }
+func (m *memoryMessage) DeliveryAttempt() *int         { return nil }
+func (m *memoryMessage) Ack()                          { m.settle(true) }
+func (m *memoryMessage) Nack()                         { m.settle(false) }
+
+// settle only reports the first ack or nack, as a Pub/Sub message ignores any after it
+func (m *memoryMessage) settle(acked bool) {
+	m.once.Do(func() {
+		m.acked <- acked
+	})
+}
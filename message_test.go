@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveFromChannel(t *testing.T) {
+	sampleServer := downstreamServer(http.StatusCreated)
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusCreated)
+	defer partyServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+
+	good := newMemoryMessage("1", []byte(line), map[string]string{"sample_summary_id": "test"})
+	missingSummary := newMemoryMessage("2", []byte(line), map[string]string{})
+	short := newMemoryMessage("3", []byte("13110000001:::WW"), map[string]string{"sample_summary_id": "test"})
+	source := newChannelSource(3)
+	source.send(good)
+	source.send(missingSummary)
+	source.send(short)
+	source.close()
+
+	// no pubsub client is needed without results or dead letter topics
+	err = worker.receive(context.Background(), nil, source)
+	assert.Nil(t, err)
+	assert.True(t, <-good.acked)
+	assert.False(t, <-missingSummary.acked)
+	assert.False(t, <-short.acked)
+}
+
+func TestReceiveNacksOnDownstreamFailure(t *testing.T) {
+	sampleServer := downstreamServer(http.StatusInternalServerError)
+	defer sampleServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+
+	msg := newMemoryMessage("1", []byte(line), map[string]string{"sample_summary_id": "test"})
+	source := newChannelSource(1)
+	source.send(msg)
+	source.close()
+
+	err = worker.receive(context.Background(), nil, source)
+	assert.Nil(t, err)
+	assert.False(t, <-msg.acked)
+}
+
+func TestMemoryMessageSettledOnce(t *testing.T) {
+	msg := newMemoryMessage("1", []byte(line), nil)
+	msg.Ack()
+	msg.Nack()
+	assert.True(t, <-msg.acked)
+}
+
+func TestReceiveCancelledStopsDownstreamRequests(t *testing.T) {
+	sampleServer, cancelled := blockingServer()
+	defer sampleServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	worker, err := newCSVWorker(context.Background(), config)
+	assert.Nil(t, err)
+
+	msg := newMemoryMessage("1", []byte(line), map[string]string{"sample_summary_id": "test"})
+	source := newChannelSource(1)
+	source.send(msg)
+
+	// as when the worker is shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = worker.receive(ctx, nil, source)
+	assert.Nil(t, err)
+	assert.False(t, <-msg.acked)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sample service request was not cancelled")
+	}
+}
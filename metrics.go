@@ -0,0 +1,29 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// downstreamMetrics are published by expvar, keyed by downstream service name, e.g.
+// party.rateLimitWaitSeconds
+var downstreamMetrics = expvar.NewMap("downstream")
+
+// serveMetrics serves the expvar metrics at /debug/vars and readiness at /ready on the metrics
+// address, if one is set
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	logger.Info("serving metrics", zap.String("addr", addr))
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/ready", readiness)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("metrics server stopped", zap.Error(err))
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	orderingNone    = "none"
+	orderingSummary = "summary"
+	orderingShard   = "shard"
+
+	orderingKeyAttribute = "original_ordering_key"
+)
+
+// Ordering decides the Pub/Sub ordering key a sample unit is published with. Keying by sample
+// summary delivers a summary's units one at a time and in order, and sharding the summary keeps
+// them in order within each shard while still processing the shards in parallel
+type Ordering struct {
+	Mode   string
+	Shards int
+}
+
+func loadOrdering() Ordering {
+	return Ordering{
+		Mode:   viper.GetString("ORDERING_KEY"),
+		Shards: viper.GetInt("ORDERING_SHARDS"),
+	}
+}
+
+func (o Ordering) enabled() bool {
+	return o.Mode == orderingSummary || o.Mode == orderingShard
+}
+
+// key is the ordering key for the nth unit of a sample summary
+func (o Ordering) key(sampleSummaryId string, n int) string {
+	switch o.Mode {
+	case orderingSummary:
+		return sampleSummaryId
+	case orderingShard:
+		return fmt.Sprintf("%s-%d", sampleSummaryId, n%o.Shards)
+	default:
+		return ""
+	}
+}
+
+func (o Ordering) validate() error {
+	switch o.Mode {
+	case orderingNone, orderingSummary:
+	case orderingShard:
+		if o.Shards < 2 {
+			return errors.New("ORDERING_SHARDS must be at least 2 when ORDERING_KEY is shard")
+		}
+	default:
+		return fmt.Errorf("ORDERING_KEY must be one of %s, %s or %s", orderingNone, orderingSummary, orderingShard)
+	}
+	return nil
+}
+
+func (o Ordering) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("key", o.Mode)
+	enc.AddInt("shards", o.Shards)
+	return nil
+}
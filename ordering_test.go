@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOrderingKey(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("", Ordering{Mode: orderingNone}.key("test", 3))
+	assert.Equal("test", Ordering{Mode: orderingSummary}.key("test", 3))
+	assert.Equal("test-1", Ordering{Mode: orderingShard, Shards: 2}.key("test", 3))
+	assert.Equal("test-0", Ordering{Mode: orderingShard, Shards: 2}.key("test", 4))
+}
+
+func TestOrderingValidation(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Ordering{Mode: orderingNone}.validate())
+	assert.Nil(Ordering{Mode: orderingSummary}.validate())
+	assert.Nil(Ordering{Mode: orderingShard, Shards: 4}.validate())
+	assert.EqualError(Ordering{Mode: orderingShard, Shards: 1}.validate(), "ORDERING_SHARDS must be at least 2 when ORDERING_KEY is shard")
+	assert.EqualError(Ordering{Mode: "unit"}.validate(), "ORDERING_KEY must be one of none, summary or shard")
+}
+
+func writeSampleFile(t *testing.T, lines int) string {
+	file := filepath.Join(t.TempDir(), "sample.csv")
+	assert.Nil(t, os.WriteFile(file, []byte(strings.Repeat(line+"\n", lines)), 0600))
+	return file
+}
+
+func TestPublishFileOrdered(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	topic, err := createTopic(client, ctx, assert)
+	defer topic.Delete(ctx)
+	topic.EnableMessageOrdering = true
+	cipher, _ := newPayloadCipher("", false)
+
+	count, err := publishFile(ctx, topic, writeSampleFile(t, 4), "test", cipher, Ordering{Mode: orderingShard, Shards: 2})
+	assert.Nil(err)
+	assert.Equal(4, count)
+
+	keys := map[string]int{}
+	for _, m := range srv.Messages() {
+		keys[m.OrderingKey]++
+	}
+	assert.Equal(map[string]int{"test-0": 2, "test-1": 2}, keys)
+}
+
+func TestPublishFileResumesOrderingKey(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	topic, err := createTopic(client, ctx, assert)
+	defer topic.Delete(ctx)
+	topic.EnableMessageOrdering = true
+	cipher, _ := newPayloadCipher("", false)
+	ordering := Ordering{Mode: orderingSummary}
+
+	srv.SetAutoPublishResponse(false)
+	srv.AddPublishResponse(nil, status.Error(codes.InvalidArgument, "rejected"))
+	count, err := publishFile(ctx, topic, writeSampleFile(t, 2), "test", cipher, ordering)
+	assert.Equal(0, count)
+	assert.ErrorContains(err, "2 of 2 lines not published, lines [1 2]")
+
+	// the key has been resumed so the file can be published again
+	srv.SetAutoPublishResponse(true)
+	count, err = publishFile(ctx, topic, writeSampleFile(t, 2), "test", cipher, ordering)
+	assert.Nil(err)
+	assert.Equal(2, count)
+}
+
+func TestResultPublishedWithOrderingKey(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	topic, err := createTopic(client, ctx, assert)
+	defer topic.Delete(ctx)
+	topic.EnableMessageOrdering = true
+	sub, err := client.CreateSubscription(ctx, "sample-file", pubsub.SubscriptionConfig{
+		Topic:                 topic,
+		EnableMessageOrdering: true,
+	})
+	assert.Nil(err)
+	defer sub.Delete(ctx)
+	resultsTopic, err := client.CreateTopic(ctx, "sample-results")
+	assert.Nil(err)
+	defer resultsTopic.Delete(ctx)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{\"id\":\"1111\"}"))
+	}))
+	defer ts.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = ts.URL
+	config.PartyService.BaseURL = ts.URL
+	config.ResultsTopic = "sample-results"
+	config.Ordering = Ordering{Mode: orderingSummary}
+
+	cipher, _ := newPayloadCipher("", false)
+	_, err = publishFile(ctx, topic, writeSampleFile(t, 1), "test", cipher, config.Ordering)
+	assert.Nil(err)
+
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(err)
+	subscribeUntilCleanup(t, worker, client)
+
+	time.Sleep(1 * time.Second)
+
+	var results int
+	for _, m := range srv.Messages() {
+		assert.Equal("test", m.OrderingKey)
+		var result Result
+		if json.Unmarshal(m.Data, &result) == nil {
+			results++
+			assert.Equal(0, m.Acks)
+		} else {
+			assert.Equal(1, m.Acks)
+		}
+	}
+	assert.Equal(1, results)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+// recoverPanics wraps a message handler so that a panic processing one message dead-letters
+// that message, rather than taking down the worker along with every other message in flight
+func recoverPanics(deadLetters *DeadLetterPublisher, handle func(context.Context, Message)) func(context.Context, Message) {
+	return func(ctx context.Context, msg Message) {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("panic processing message",
+					zap.String("messageId", msg.ID()),
+					zap.Any("panic", r),
+					zap.ByteString("stack", debug.Stack()))
+				deadLetters.deadLetter(ctx, msg, fmt.Sprintf("panic processing message: %v", r))
+			}
+		}()
+		handle(ctx, msg)
+	}
+}
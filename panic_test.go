@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// panickingMessage panics part way through being processed, as a bug handling an unexpected line
+// would
+type panickingMessage struct {
+	*memoryMessage
+}
+
+func (m panickingMessage) DeliveryAttempt() *int {
+	panic("unexpected line")
+}
+
+func TestMalformedLineCannotCrashWorker(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	deadLetterTopic, err := client.CreateTopic(ctx, "sample-file-dlq")
+	assert.Nil(err)
+	defer deadLetterTopic.Delete(ctx)
+	sampleServer := downstreamServer(http.StatusCreated)
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusCreated)
+	defer partyServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	config.DeadLetterTopic = "sample-file-dlq"
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(err)
+
+	attributes := map[string]string{"sample_summary_id": "test"}
+	short := newMemoryMessage("short", []byte("13110000001:::WW"), attributes)
+	panicking := panickingMessage{newMemoryMessage("panicking", []byte(line), attributes)}
+	good := newMemoryMessage("good", []byte(line), attributes)
+	source := newChannelSource(3)
+	source.send(short)
+	source.send(panicking)
+	source.send(good)
+	source.close()
+	err = worker.receive(ctx, client, source)
+	assert.Nil(err)
+
+	// the bad messages are acked once they've been dead-lettered, and the worker carries on
+	assert.True(<-short.acked)
+	assert.True(<-panicking.acked)
+	assert.True(<-good.acked)
+	reasons := map[string]string{}
+	for _, m := range srv.Messages() {
+		reasons[m.Attributes[deadLetterMessageIdAttribute]] = m.Attributes[deadLetterReasonAttribute]
+	}
+	assert.Equal(2, len(reasons))
+	assert.Contains(reasons["short"], "invalid sample: RUSIC92 must be a five digit SIC code")
+	assert.Equal("panic processing message: unexpected line", reasons["panicking"])
+}
+
+func TestPanicNackedWithoutDeadLetterTopic(t *testing.T) {
+	source := newChannelSource(1)
+	msg := newMemoryMessage("1", []byte(line), map[string]string{})
+	source.send(msg)
+	source.close()
+
+	handler := recoverPanics(nil, func(ctx context.Context, msg Message) {
+		panic("boom")
+	})
+	err := source.Receive(context.Background(), handler)
+	assert.Nil(t, err)
+
+	// the message is nacked to be redelivered rather than lost
+	assert.False(t, <-msg.acked)
+}
@@ -2,98 +2,99 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
-	"time"
 
-	"cloud.google.com/go/pubsub"
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
 type Party struct {
-	SAMPLEUNITREF   string          `json:"sampleUnitRef"`
-	SAMPLESUMMARYID string          `json:"sampleSummaryId"`
-	SAMPLEUNITTYPE  string          `json:"sampleUnitType""`
-	Attributes      Attributes      `json:"attributes""`
-	msg             *pubsub.Message `json:"-"`
+	SAMPLEUNITREF   string         `json:"sampleUnitRef"`
+	SAMPLESUMMARYID string         `json:"sampleSummaryId"`
+	SAMPLEUNITTYPE  string         `json:"sampleUnitType"`
+	Attributes      Attributes     `json:"attributes"`
+	messageId       string         `json:"-"`
+	service         *ServiceClient `json:"-"`
 }
 
 type Attributes struct {
-	CHECKLETTER  string `json:"checkletter"`
-	FROSIC92     string `json:"frosic92"`
-	RUSIC92      string `json:"rusic92"`
-	FROSIC2007   string `json:"frosic2007"`
-	RUSIC2007    string `json:"rusic2007"`
-	FROEMPMENT   int    `json:"froempment"`
-	FROTOVER     int    `json:"frotover"`
-	ENTREF       string `json:"entref"`
-	LEGALSTATUS  string `json:"legalstatus"`
-	NAME         string `json:"name"`
-	ENTREPMKR    string `json:"entrepmkr"`
-	REGION       string `json:"region"`
-	BIRTHDATE    string `json:"birthdate"`
-	ENTNAME1     string `json:"entname1"`
-	ENTNAME2     string `json:"entname2"`
-	ENTNAME3     string `json:"entname3"`
-	RUNAME1      string `json:"runame1"`
-	RUNAME2      string `json:"runame2"`
-	RUNAME3      string `json:"runame3"`
-	TRADSTYLE1   string `json:"tradstyle1"`
-	TRADSTYLE2   string `json:"tradstyle2"`
-	TRADSTYLE3   string `json:"tradstyle3"`
-	SELTYPE      string `json:"seltype"`
-	INCLEXCL     string `json:"inclexcl"`
-	CELLNO       int    `json:"cellNo"`
-	FORMTYPE     string `json:"formType"`
-	CURRENCY     string `json:"currency"`
-	SAMPLEUNITID string `json:"sampleUnitId"`
+	CHECKLETTER  string           `json:"checkletter"`
+	FROSIC92     string           `json:"frosic92"`
+	RUSIC92      string           `json:"rusic92"`
+	FROSIC2007   string           `json:"frosic2007"`
+	RUSIC2007    string           `json:"rusic2007"`
+	FROEMPMENT   Optional[int]    `json:"froempment,omitzero"`
+	FROTOVER     Optional[int]    `json:"frotover,omitzero"`
+	ENTREF       string           `json:"entref"`
+	LEGALSTATUS  string           `json:"legalstatus"`
+	ENTREPMKR    string           `json:"entrepmkr"`
+	REGION       string           `json:"region"`
+	BIRTHDATE    Optional[string] `json:"birthdate,omitzero"`
+	ENTNAME1     string           `json:"entname1"`
+	ENTNAME2     string           `json:"entname2"`
+	ENTNAME3     string           `json:"entname3"`
+	RUNAME1      string           `json:"runame1"`
+	RUNAME2      string           `json:"runame2"`
+	RUNAME3      string           `json:"runame3"`
+	TRADSTYLE1   string           `json:"tradstyle1"`
+	TRADSTYLE2   string           `json:"tradstyle2"`
+	TRADSTYLE3   string           `json:"tradstyle3"`
+	SELTYPE      string           `json:"seltype"`
+	INCLEXCL     string           `json:"inclexcl"`
+	CELLNO       Optional[int]    `json:"cellNo,omitzero"`
+	FORMTYPE     string           `json:"formType"`
+	CURRENCY     string           `json:"currency"`
+	SAMPLEUNITID string           `json:"sampleUnitId"`
+
+	// derived are the attributes computed by the derived field rules
+	derived map[string]string
 }
 
-func processParty(line []string, sampleSummaryId string, sampleUnitId string, msg *pubsub.Message) error {
+func processParty(ctx context.Context, service *ServiceClient, record *Record, sampleSummaryId string, sampleUnitId string, messageId string) (string, error) {
 	logger.Debug("processing party")
-	p := newParty(line, sampleSummaryId, sampleUnitId)
-	p.msg = msg
-	return p.sendToPartyService()
+	p := newParty(record, sampleSummaryId, sampleUnitId, service.omitEmpty())
+	p.messageId = messageId
+	p.service = service
+	return p.sendToPartyService(ctx)
 }
 
-func newParty(line []string, sampleSummaryId string, sampleUnitId string) *Party {
+func newParty(record *Record, sampleSummaryId string, sampleUnitId string, omitEmpty bool) *Party {
 	attr := &Attributes{
-		CHECKLETTER:  setIfNotEmpty(&line[1]),
-		FROSIC92:     setIfNotEmpty(&line[2]),
-		RUSIC92:      setIfNotEmpty(&line[3]),
-		FROSIC2007:   setIfNotEmpty(&line[4]),
-		RUSIC2007:    setIfNotEmpty(&line[5]),
-		FROEMPMENT:   convertToInt(line[6]),
-		FROTOVER:     convertToInt(line[7]),
-		ENTREF:       setIfNotEmpty(&line[8]),
-		LEGALSTATUS:  setIfNotEmpty(&line[9]),
-		NAME:         "",
-		ENTREPMKR:    setIfNotEmpty(&line[10]),
-		REGION:       setIfNotEmpty(&line[11]),
-		BIRTHDATE:    setIfNotEmpty(&line[12]),
-		ENTNAME1:     setIfNotEmpty(&line[13]),
-		ENTNAME2:     setIfNotEmpty(&line[14]),
-		ENTNAME3:     setIfNotEmpty(&line[15]),
-		RUNAME1:      setIfNotEmpty(&line[16]),
-		RUNAME2:      setIfNotEmpty(&line[17]),
-		RUNAME3:      setIfNotEmpty(&line[18]),
-		TRADSTYLE1:   setIfNotEmpty(&line[19]),
-		TRADSTYLE2:   setIfNotEmpty(&line[20]),
-		TRADSTYLE3:   setIfNotEmpty(&line[21]),
-		SELTYPE:      setIfNotEmpty(&line[22]),
-		INCLEXCL:     setIfNotEmpty(&line[23]),
-		CELLNO:       convertToInt(line[24]),
-		FORMTYPE:     setIfNotEmpty(&line[25]),
-		CURRENCY:     setIfNotEmpty(&line[26]),
+		CHECKLETTER:  record.CHECKLETTER,
+		FROSIC92:     string(record.FROSIC92),
+		RUSIC92:      string(record.RUSIC92),
+		FROSIC2007:   string(record.FROSIC2007),
+		RUSIC2007:    string(record.RUSIC2007),
+		FROEMPMENT:   optionalInt(record.FROEMPMENT, omitEmpty),
+		FROTOVER:     optionalInt(record.FROTOVER, omitEmpty),
+		ENTREF:       record.ENTREF,
+		LEGALSTATUS:  record.LEGALSTATUS,
+		ENTREPMKR:    record.ENTREPMKR,
+		REGION:       record.REGION,
+		BIRTHDATE:    optionalDate(record.BIRTHDATE, omitEmpty),
+		ENTNAME1:     record.ENTNAME1,
+		ENTNAME2:     record.ENTNAME2,
+		ENTNAME3:     record.ENTNAME3,
+		RUNAME1:      record.RUNAME1,
+		RUNAME2:      record.RUNAME2,
+		RUNAME3:      record.RUNAME3,
+		TRADSTYLE1:   record.TRADSTYLE1,
+		TRADSTYLE2:   record.TRADSTYLE2,
+		TRADSTYLE3:   record.TRADSTYLE3,
+		SELTYPE:      record.SELTYPE,
+		INCLEXCL:     record.INCLEXCL,
+		CELLNO:       optionalInt(record.CELLNO, omitEmpty),
+		FORMTYPE:     record.FORMTYPE,
+		CURRENCY:     record.CURRENCY,
 		SAMPLEUNITID: sampleUnitId,
+		derived:      record.Derived,
 	}
 	party := &Party{
-		SAMPLEUNITREF:   line[0],
+		SAMPLEUNITREF:   record.SAMPLEUNITREF,
 		SAMPLESUMMARYID: sampleSummaryId,
 		SAMPLEUNITTYPE:  "B",
 		Attributes:      *attr,
@@ -102,40 +103,19 @@ func newParty(line []string, sampleSummaryId string, sampleUnitId string) *Party
 	return party
 }
 
-func setIfNotEmpty(value *string) string {
-	if value == nil {
-		return ""
-	} else {
-		return *value
-	}
-}
-
-func convertToInt(value string) int {
-	convertedValue := 0
-	if value != "" {
-		var err error
-		convertedValue, err = strconv.Atoi(value)
-		if err != nil {
-			logger.Error("error converting to int", zap.Error(err))
-			convertedValue = 0
-		}
-	}
-	return convertedValue
-}
-
-func (p *Party) sendToPartyService() error {
+func (p *Party) sendToPartyService(ctx context.Context) (string, error) {
 	payload, err := p.marshall()
 	if err != nil {
-		return err
+		return "", err
 	}
 	sampleServiceUrl := p.getPartyServiceUrl()
-	return p.sendHttpRequest(sampleServiceUrl, payload)
+	return p.sendHttpRequest(ctx, sampleServiceUrl, payload)
 }
 
 func (p Party) marshall() ([]byte, error) {
 	//marshall to JSON and send to the sample service as a POST request
 	payload, err := json.Marshal(p)
-	logger.Debug("marshalled party to json", zap.ByteString("payload", payload))
+	logger.Debug("marshalled party to json", redactedJSON("payload", payload))
 	if err != nil {
 		logger.Error("unable to marshall party to json", zap.Error(err))
 		return nil, err
@@ -144,55 +124,40 @@ func (p Party) marshall() ([]byte, error) {
 }
 
 func (p Party) getPartyServiceUrl() string {
-	partyServiceBaseUrl := viper.GetString("PARTY_SERVICE_BASE_URL")
+	partyServiceBaseUrl := p.service.baseUrl()
 	partyServicePath := "/party-api/v1/parties"
 	partyServiceUrl := partyServiceBaseUrl + partyServicePath
 	logger.Info("using party service url", zap.String("url", partyServiceUrl))
 	return partyServiceUrl
 }
 
-func (p Party) sendHttpRequest(url string, payload []byte) error {
-	username := viper.GetString("SECURITY_USER_NAME")
-	password := viper.GetString("SECURITY_USER_PASSWORD")
-
-	transport := &http.Transport{
-		DisableKeepAlives:   false,
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 10,
-		IdleConnTimeout:     1500 * time.Millisecond, // Gunicorn closes idle connections after 2 secs
-	}
-
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second,
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+func (p Party) sendHttpRequest(ctx context.Context, url string, payload []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
 	if err != nil {
 		logger.Error("error creating HTTP request", zap.Error(err))
-		return err
+		return "", err
 	}
-	req.SetBasicAuth(username, password)
 	req.Header.Add("content-type", "application/json")
-	resp, err := client.Do(req)
+	resp, err := p.service.do(req)
 	if err != nil {
 		logger.Warn("error sending HTTP request", zap.Error(err))
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		logger.Error("error reading HTTP response", zap.Error(err))
-		return err
+		return "", err
 	}
-	logger.Debug("response received", zap.ByteString("body", body))
+	logger.Debug("response received", redactedJSON("body", body))
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
-		logger.Info("party created", zap.String("sampleUnitRef", p.SAMPLEUNITREF), zap.String("messageId", p.msg.ID))
-		return nil
+		logger.Info("party created", zap.String("sampleUnitRef", p.SAMPLEUNITREF), zap.String("messageId", p.messageId))
+		return partyCreated, nil
 	} else if resp.StatusCode == http.StatusConflict {
-		logger.Warn("party already exists", zap.String("sampleUnitRef", p.SAMPLEUNITREF), zap.String("messageId", p.msg.ID))
-		return nil
+		logger.Warn("party already exists", zap.String("sampleUnitRef", p.SAMPLEUNITREF), zap.String("messageId", p.messageId))
+		return partyExists, nil
 	} else {
-		logger.Error("party not created", zap.Int("status code", resp.StatusCode), zap.String("sampleUnitRef", p.SAMPLEUNITREF), zap.String("messageId", p.msg.ID))
-		return errors.New(fmt.Sprintf("sample not created - status code %d", resp.StatusCode))
+		logger.Error("party not created", zap.Int("status code", resp.StatusCode), zap.String("sampleUnitRef", p.SAMPLEUNITREF), zap.String("messageId", p.messageId))
+		return "", errors.New(fmt.Sprintf("sample not created - status code %d", resp.StatusCode))
 	}
 }
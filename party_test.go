@@ -1,9 +1,8 @@
 package main
 
 import (
-	"cloud.google.com/go/pubsub"
+	"context"
 	"fmt"
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
@@ -21,20 +20,14 @@ func TestPartySuccess(t *testing.T) {
 	defer ts.Close()
 
 	fmt.Printf("Setting party service base url %v", ts.URL)
-	viper.Set("PARTY_SERVICE_BASE_URL", ts.URL)
+	service := testServiceClient(ts.URL)
 
 	line := []byte("13110000001:::::::::::WW:::::OFFICE FOR NATIONAL STATISTICS:::::::::0001:")
 
-	msg := &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
-	sample, _ := readSampleLine(line)
-	err := processParty(sample, "test", "test", msg)
+	sample, _ := readSampleLine(line, sampleSchemaV1)
+	outcome, err := processParty(context.Background(), service, testRecord(t, sample), "test", "test", "1")
 	assert.Nil(err, "error should be nil")
+	assert.Equal(partyCreated, outcome)
 }
 
 func TestPartyConflict(t *testing.T) {
@@ -47,20 +40,14 @@ func TestPartyConflict(t *testing.T) {
 	defer ts.Close()
 
 	fmt.Printf("Setting party service base url %v", ts.URL)
-	viper.Set("PARTY_SERVICE_BASE_URL", ts.URL)
+	service := testServiceClient(ts.URL)
 
 	line := []byte("13110000001:::::::::::WW:::::OFFICE FOR NATIONAL STATISTICS:::::::::0001:")
 
-	msg := &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
-	sample, _ := readSampleLine(line)
-	err := processParty(sample, "test", "test", msg)
+	sample, _ := readSampleLine(line, sampleSchemaV1)
+	outcome, err := processParty(context.Background(), service, testRecord(t, sample), "test", "test", "1")
 	assert.Nil(err, "error should be nil")
+	assert.Equal(partyExists, outcome)
 }
 
 func TestPartyError(t *testing.T) {
@@ -73,41 +60,28 @@ func TestPartyError(t *testing.T) {
 	defer ts.Close()
 
 	fmt.Printf("Setting party service base url %v", ts.URL)
-	viper.Set("PARTY_SERVICE_BASE_URL", ts.URL)
+	service := testServiceClient(ts.URL)
 
 	line := []byte("13110000001:::::::::::WW:::::OFFICE FOR NATIONAL STATISTICS:::::::::0001:")
 
-	msg := &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
-	sample, _ := readSampleLine(line)
-	err := processParty(sample, "test", "test", msg)
+	sample, _ := readSampleLine(line, sampleSchemaV1)
+	_, err := processParty(context.Background(), service, testRecord(t, sample), "test", "test", "1")
 	assert.NotNil(err, "error should be nil")
 }
 
 func TestPartyServerURL(t *testing.T) {
-	p := &Party{}
+	p := &Party{service: testServiceClient("http://localhost:8080")}
 
 	assert := assert.New(t)
-	// set env variables and check url is correct
-	viper.Set("PARTY_SERVICE_BASE_URL", "https://127.0.0.1")
+	// set base url and check url is correct
+	p.service = testServiceClient("https://127.0.0.1")
 
 	assert.Equal("https://127.0.0.1/party-api/v1/parties", p.getPartyServiceUrl())
 }
 
 func TestPartySendHttpRequest(t *testing.T) {
-	p := &Party{}
-	p.msg = &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
+	p := &Party{service: testServiceClient("http://localhost:8080")}
+	p.messageId = "1"
 	assert := assert.New(t)
 	payload := []byte("TEST")
 
@@ -120,35 +94,23 @@ func TestPartySendHttpRequest(t *testing.T) {
 	}))
 	ts.Start()
 	defer ts.Close()
-	err := p.sendHttpRequest(ts.URL, payload)
+	_, err := p.sendHttpRequest(context.Background(), ts.URL, payload)
 	assert.Nil(err, "error should be nil")
 }
 
 func TestPartySendHttpRequestBadUrl(t *testing.T) {
-	p := &Party{}
-	p.msg = &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
+	p := &Party{service: testServiceClient("http://localhost:8080")}
+	p.messageId = "1"
 
 	assert := assert.New(t)
 	payload := []byte("TEST")
-	err := p.sendHttpRequest("http://localhost", payload)
+	_, err := p.sendHttpRequest(context.Background(), "http://localhost", payload)
 	assert.NotNil(err, "error should be nil")
 }
 
 func TestPartySendHttpRequestWrongStatus(t *testing.T) {
-	p := &Party{}
-	p.msg = &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
+	p := &Party{service: testServiceClient("http://localhost:8080")}
+	p.messageId = "1"
 
 	assert := assert.New(t)
 	payload := []byte("TEST")
@@ -162,6 +124,6 @@ func TestPartySendHttpRequestWrongStatus(t *testing.T) {
 	}))
 	ts.Start()
 	defer ts.Close()
-	err := p.sendHttpRequest(ts.URL, payload)
+	_, err := p.sendHttpRequest(context.Background(), ts.URL, payload)
 	assert.NotNil(err, "error should be nil")
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/zap"
+)
+
+// preflightTimeout bounds the whole of the preflight checks, so a service that accepts connections
+// but never responds doesn't hold up startup for its full request timeout
+const preflightTimeout = 30 * time.Second
+
+// deletedTopic is what pubsub reports as the topic of a subscription whose topic was deleted
+const deletedTopic = "_deleted-topic_"
+
+// preflight checks the worker's configuration against the things it depends on before any
+// message is received, so a wrong subscription, topic or service url is reported at startup with
+// what to fix rather than when the first message fails. Every check is run and all of the
+// failures are returned together
+func preflight(ctx context.Context, config *Config, client *pubsub.Client, workers []*CSVWorker) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	var errs []error
+	if client != nil {
+		errs = append(errs, checkTopic(ctx, client, "PUBSUB_RESULTS_TOPIC", config.ResultsTopic))
+		errs = append(errs, checkTopic(ctx, client, "PUBSUB_DEAD_LETTER_TOPIC", config.DeadLetterTopic))
+	}
+	// subscriptions can share a downstream service, which only needs pinging once
+	pinged := map[string]bool{}
+	for _, cw := range workers {
+		if config.Source == sourcePubSub {
+			errs = append(errs, cw.checkSubscription(ctx, client))
+		}
+		for _, service := range []*ServiceClient{cw.sampleService, cw.partyService} {
+			if url := service.healthURL(); url != "" && !pinged[url] {
+				pinged[url] = true
+				errs = append(errs, service.checkHealth(ctx))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkSubscription checks the subscription exists and is attached to its topic, PUBSUB_TOPIC
+// unless the subscriptions file gives it another, and warns when nothing will catch a message that
+// can never be processed
+func (cw CSVWorker) checkSubscription(ctx context.Context, client *pubsub.Client) error {
+	subId := cw.config.SubscriptionID
+	sub := client.Subscription(subId)
+	config, err := sub.Config(ctx)
+	if err != nil {
+		if fatalReceiveError(err) {
+			return fmt.Errorf("subscription %s can't be read in project %s - check PUBSUB_SUB_ID and GOOGLE_CLOUD_PROJECT, and that the worker's service account is a subscriber: %w",
+				subId, cw.config.ProjectID, err)
+		}
+		return fmt.Errorf("unable to check subscription %s: %w", subId, err)
+	}
+	if config.Topic == nil || config.Topic.ID() == deletedTopic {
+		return fmt.Errorf("the topic of subscription %s has been deleted - recreate the subscription on topic %s", subId, cw.config.Topic)
+	}
+	if config.Topic.ID() != cw.config.Topic {
+		return fmt.Errorf("subscription %s is attached to topic %s, not %s - check the subscription and PUBSUB_TOPIC, or its topic in SUBSCRIPTIONS_FILE",
+			subId, config.Topic.ID(), cw.config.Topic)
+	}
+	if config.DeadLetterPolicy == nil {
+		if cw.config.DeadLetterTopic == "" {
+			logger.Warn("subscription has no dead letter policy and PUBSUB_DEAD_LETTER_TOPIC is not set - messages that can never be processed will be redelivered until they expire",
+				zap.String("subId", subId))
+		}
+		logger.Info("subscription checked", zap.String("subId", subId), zap.String("topic", config.Topic.ID()))
+		return nil
+	}
+	// the policy names the topic in full, and it may be in another project
+	deadLetterTopic := config.DeadLetterPolicy.DeadLetterTopic
+	project, topicId := cw.config.ProjectID, path.Base(deadLetterTopic)
+	if parts := strings.Split(deadLetterTopic, "/"); len(parts) == 4 {
+		project = parts[1]
+	}
+	exists, err := client.TopicInProject(topicId, project).Exists(ctx)
+	if err != nil {
+		// the worker's service account needn't be able to see the topic for Pub/Sub to use it
+		logger.Warn("unable to check subscription dead letter topic", zap.String("subId", subId), zap.String("deadLetterTopic", deadLetterTopic), zap.Error(err))
+	} else if !exists {
+		return fmt.Errorf("dead letter topic %s of subscription %s doesn't exist - create it or update the subscription's dead letter policy", deadLetterTopic, subId)
+	}
+	logger.Info("subscription checked",
+		zap.String("subId", subId),
+		zap.String("topic", config.Topic.ID()),
+		zap.String("deadLetterTopic", deadLetterTopic),
+		zap.Int("maxDeliveryAttempts", config.DeadLetterPolicy.MaxDeliveryAttempts))
+	return nil
+}
+
+// checkTopic checks a topic the worker publishes to exists, if one is configured
+func checkTopic(ctx context.Context, client *pubsub.Client, setting string, topicId string) error {
+	if topicId == "" {
+		return nil
+	}
+	exists, err := client.Topic(topicId).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to check %s %s - check the worker's service account can view it: %w", setting, topicId, err)
+	}
+	if !exists {
+		return fmt.Errorf("%s %s doesn't exist in project %s - check %s and GOOGLE_CLOUD_PROJECT", setting, topicId, client.Project(), setting)
+	}
+	logger.Info("topic checked", zap.String("setting", setting), zap.String("topic", topicId))
+	return nil
+}
+
+// healthURL is where the service is pinged, or empty when it has no health path configured
+func (sc *ServiceClient) healthURL() string {
+	if sc.config.HealthPath == "" {
+		return ""
+	}
+	return strings.TrimSuffix(sc.config.BaseURL, "/") + sc.config.HealthPath
+}
+
+// checkHealth pings the service's health endpoint, authenticated as any other request would be
+// but without waiting on its rate limit
+func (sc *ServiceClient) checkHealth(ctx context.Context) error {
+	prefix := strings.ToUpper(sc.config.Name) + "_SERVICE"
+	url := sc.healthURL()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%s service health url %s is invalid - check %s_BASE_URL and %s_HEALTH_PATH: %w", sc.config.Name, url, prefix, prefix, err)
+	}
+	if err := sc.auth.authenticate(req); err != nil {
+		return fmt.Errorf("unable to authenticate to %s service - check %s_AUTH: %w", sc.config.Name, prefix, err)
+	}
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s service is unreachable at %s - check %s_BASE_URL: %w", sc.config.Name, url, prefix, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s service responded %d from %s - check %s_BASE_URL and %s_HEALTH_PATH", sc.config.Name, resp.StatusCode, url, prefix, prefix)
+	}
+	logger.Info("downstream service checked", zap.String("service", sc.config.Name), zap.String("url", url))
+	return nil
+}
+
+// check runs the preflight checks on their own and exits non-zero if any fail, e.g.
+//
+//	worker check
+func check(ctx context.Context, config *Config) {
+	var client *pubsub.Client
+	var err error
+	if config.Source == sourcePubSub {
+		client, err = pubsub.NewClient(ctx, config.ProjectID)
+	} else {
+		client, err = newOptionalPubSubClient(ctx, config)
+	}
+	if err != nil {
+		logger.Fatal("failed to create client", zap.Error(err))
+	}
+	if client != nil {
+		defer client.Close()
+	}
+	workers, err := newCSVWorkers(ctx, config)
+	if err != nil {
+		logger.Fatal("unable to create worker", zap.Error(err))
+	}
+	if err := preflight(ctx, config, client, workers); err != nil {
+		logger.Fatal("preflight checks failed", zap.Error(err))
+	}
+	logger.Info("preflight checks passed")
+}
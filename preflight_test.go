@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func testPreflightClient(t *testing.T) (context.Context, *pubsub.Client) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	t.Cleanup(func() { conn.Close() })
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	t.Cleanup(func() { client.Close() })
+	return ctx, client
+}
+
+func testPreflight(t *testing.T, ctx context.Context, config *Config, client *pubsub.Client) error {
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(t, err)
+	return preflight(ctx, config, client, []*CSVWorker{worker})
+}
+
+func TestPreflightPasses(t *testing.T) {
+	ctx, client := testPreflightClient(t)
+	assert := assert.New(t)
+	topic, err := client.CreateTopic(ctx, "sample-file")
+	assert.Nil(err)
+	deadLetterTopic, err := client.CreateTopic(ctx, "sample-file-dlq")
+	assert.Nil(err)
+	_, err = client.CreateSubscription(ctx, "sample-file", pubsub.SubscriptionConfig{
+		Topic:            topic,
+		DeadLetterPolicy: &pubsub.DeadLetterPolicy{DeadLetterTopic: deadLetterTopic.String(), MaxDeliveryAttempts: 5},
+	})
+	assert.Nil(err)
+	_, err = client.CreateTopic(ctx, "sample-results")
+	assert.Nil(err)
+	services := downstreamServer(http.StatusOK)
+	defer services.Close()
+
+	config := testConfig()
+	config.ResultsTopic = "sample-results"
+	config.SampleService.BaseURL = services.URL
+	config.SampleService.HealthPath = "/info"
+	config.PartyService.BaseURL = services.URL
+	config.PartyService.HealthPath = "/info"
+	assert.Nil(testPreflight(t, ctx, config, client))
+}
+
+func TestPreflightMissingSubscription(t *testing.T) {
+	ctx, client := testPreflightClient(t)
+	err := testPreflight(t, ctx, testConfig(), client)
+	assert.ErrorContains(t, err, "subscription sample-file can't be read in project rm-ras-sandbox - check PUBSUB_SUB_ID and GOOGLE_CLOUD_PROJECT")
+}
+
+func TestPreflightSubscriptionOnOtherTopic(t *testing.T) {
+	ctx, client := testPreflightClient(t)
+	assert := assert.New(t)
+	topic, err := client.CreateTopic(ctx, "other")
+	assert.Nil(err)
+	_, err = client.CreateSubscription(ctx, "sample-file", pubsub.SubscriptionConfig{Topic: topic})
+	assert.Nil(err)
+
+	err = testPreflight(t, ctx, testConfig(), client)
+	assert.ErrorContains(err, "subscription sample-file is attached to topic other, not sample-file")
+}
+
+func TestPreflightSubscriptionTopicFromFile(t *testing.T) {
+	ctx, client := testPreflightClient(t)
+	assert := assert.New(t)
+	config := testConfig()
+	config.Subscriptions = nil
+	for _, id := range []string{"survey-a", "survey-b"} {
+		topic, err := client.CreateTopic(ctx, id)
+		assert.Nil(err)
+		_, err = client.CreateSubscription(ctx, id, pubsub.SubscriptionConfig{Topic: topic})
+		assert.Nil(err)
+		config.Subscriptions = append(config.Subscriptions, Subscription{ID: id, Topic: id})
+	}
+
+	workers, err := newCSVWorkers(ctx, config)
+	assert.Nil(err)
+	assert.Nil(preflight(ctx, config, client, workers))
+}
+
+func TestPreflightMissingTopics(t *testing.T) {
+	ctx, client := testPreflightClient(t)
+	assert := assert.New(t)
+	topic, err := client.CreateTopic(ctx, "sample-file")
+	assert.Nil(err)
+	_, err = client.CreateSubscription(ctx, "sample-file", pubsub.SubscriptionConfig{Topic: topic})
+	assert.Nil(err)
+
+	config := testConfig()
+	config.ResultsTopic = "sample-results"
+	config.DeadLetterTopic = "sample-file-dlq"
+	err = testPreflight(t, ctx, config, client)
+	assert.ErrorContains(err, "PUBSUB_RESULTS_TOPIC sample-results doesn't exist in project rm-ras-sandbox")
+	assert.ErrorContains(err, "PUBSUB_DEAD_LETTER_TOPIC sample-file-dlq doesn't exist in project rm-ras-sandbox")
+}
+
+func TestPreflightDownstreamUnhealthy(t *testing.T) {
+	ctx, client := testPreflightClient(t)
+	assert := assert.New(t)
+	topic, err := client.CreateTopic(ctx, "sample-file")
+	assert.Nil(err)
+	_, err = client.CreateSubscription(ctx, "sample-file", pubsub.SubscriptionConfig{Topic: topic})
+	assert.Nil(err)
+	sampleServer := downstreamServer(http.StatusServiceUnavailable)
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusOK)
+	partyServer.Close()
+
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.SampleService.HealthPath = "/info"
+	config.PartyService.BaseURL = partyServer.URL
+	config.PartyService.HealthPath = "/info"
+	err = testPreflight(t, ctx, config, client)
+	assert.ErrorContains(err, "sample service responded 503 from "+sampleServer.URL+"/info - check SAMPLE_SERVICE_BASE_URL")
+	assert.ErrorContains(err, "party service is unreachable at "+partyServer.URL+"/info - check PARTY_SERVICE_BASE_URL")
+
+	// without health paths the services aren't pinged
+	config.SampleService.HealthPath = ""
+	config.PartyService.HealthPath = ""
+	assert.Nil(testPreflight(t, ctx, config, client))
+}
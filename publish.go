@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/zap"
+)
+
+// publish loads or replays a sample file by hand, publishing each line as a message for the
+// worker in the same way as the sample file uploader, e.g.
+//
+//	worker publish -file sample.csv -sample-summary-id 1a2b3c
+func publish(ctx context.Context, config *Config, args []string) {
+	flags := flag.NewFlagSet("publish", flag.ExitOnError)
+	file := flags.String("file", "", "sample file to publish, one sample unit per line")
+	sampleSummaryId := flags.String("sample-summary-id", "", "sample summary the file belongs to")
+	flags.Parse(args)
+	if *file == "" || *sampleSummaryId == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cipher, err := newPayloadCipher(config.PayloadKeyFile, config.PayloadEncryptionRequired)
+	if err != nil {
+		logger.Fatal("unable to load payload key", zap.Error(err))
+	}
+	client, err := pubsub.NewClient(ctx, config.ProjectID)
+	if err != nil {
+		logger.Fatal("failed to create client", zap.Error(err))
+	}
+	defer client.Close()
+	topic := client.Topic(config.Topic)
+	topic.EnableMessageOrdering = config.Ordering.enabled()
+	defer topic.Stop()
+
+	count, err := publishFile(ctx, topic, *file, *sampleSummaryId, cipher, config.Ordering)
+	if err != nil {
+		logger.Fatal("error publishing sample file", zap.Error(err), zap.Int("published", count))
+	}
+	logger.Info("sample file published", zap.String("topic", config.Topic), zap.Int("published", count))
+}
+
+// publishFile publishes each line of the file, with an ordering key when ordering is enabled. A
+// failed publish pauses its ordering key and fails the lines queued behind it, so every failed
+// line is reported and the key resumed for them to be published again
+func publishFile(ctx context.Context, topic *pubsub.Topic, path string, sampleSummaryId string, cipher *PayloadCipher, ordering Ordering) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	type pending struct {
+		line   int
+		key    string
+		result *pubsub.PublishResult
+	}
+	var results []pending
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		// the scanner reuses its buffer so take a copy of each line
+		line := append([]byte(nil), scanner.Bytes()...)
+		if len(line) == 0 {
+			continue
+		}
+		attributes := map[string]string{
+			"sample_summary_id": sampleSummaryId,
+		}
+		data, err := cipher.encrypt(line, attributes)
+		if err != nil {
+			return 0, err
+		}
+		key := ordering.key(sampleSummaryId, len(results))
+		results = append(results, pending{
+			line:   n,
+			key:    key,
+			result: topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attributes, OrderingKey: key}),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	var failed []int
+	var firstErr error
+	for _, p := range results {
+		if _, err := p.result.Get(ctx); err != nil {
+			logger.Error("unable to publish line", zap.Int("line", p.line), zap.String("orderingKey", p.key), zap.Error(err))
+			if p.key != "" {
+				topic.ResumePublish(p.key)
+			}
+			failed = append(failed, p.line)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		published++
+	}
+	if len(failed) > 0 {
+		return published, fmt.Errorf("%d of %d lines not published, lines %v: %w", len(failed), len(results), failed, firstErr)
+	}
+	return published, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestPublishEncryptedFile(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	topic, err := createTopic(client, ctx, assert)
+	defer topic.Delete(ctx)
+	sub := createSubscription(client, ctx, err, topic, assert)
+	defer sub.Delete(ctx)
+
+	file := filepath.Join(t.TempDir(), "sample.csv")
+	assert.Nil(os.WriteFile(file, []byte(line+"\n\n"+line+"\n"), 0600))
+
+	config := testConfig()
+	config.PayloadKeyFile = writePayloadKey(t)
+	config.PayloadEncryptionRequired = true
+	cipher, err := newPayloadCipher(config.PayloadKeyFile, true)
+	assert.Nil(err)
+
+	count, err := publishFile(ctx, topic, file, "test", cipher, Ordering{Mode: orderingNone})
+	assert.Nil(err)
+	assert.Equal(2, count)
+
+	for _, m := range srv.Messages() {
+		assert.Equal(encryptionAESGCM, m.Attributes[encryptionAttribute])
+		assert.NotContains(string(m.Data), "OFFICE FOR NATIONAL STATISTICS")
+	}
+
+	// and the worker can decrypt and process them
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{\"id\":\"1111\"}"))
+	}))
+	defer ts.Close()
+	config.SampleService.BaseURL = ts.URL
+	config.PartyService.BaseURL = ts.URL
+
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(err)
+	subscribeUntilCleanup(t, worker, client)
+
+	time.Sleep(1 * time.Second)
+
+	for _, m := range srv.Messages() {
+		assert.Equal(1, m.Acks)
+	}
+}
+
+func TestPublishMissingFile(t *testing.T) {
+	cipher, _ := newPayloadCipher("", false)
+	_, err := publishFile(context.Background(), nil, "/does/not/exist", "test", cipher, Ordering{Mode: orderingNone})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	pushPath = "/push"
+	// a pubsub message is at most 10MB, which grows by a third when base64 encoded
+	maxPushEnvelopeBytes = 14 << 20
+)
+
+// validateToken checks a push request's OIDC token, and is swapped out in tests
+var validateToken = idtoken.Validate
+
+// pushEnvelope is the body of a request from a Pub/Sub push subscription, where the data is
+// base64 encoded
+type pushEnvelope struct {
+	Message struct {
+		ID          string            `json:"messageId"`
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt *int   `json:"deliveryAttempt"`
+}
+
+// pushMessage is a message pushed by Pub/Sub, which is settled by responding to the request
+type pushMessage struct {
+	request  context.Context
+	envelope pushEnvelope
+	response chan pushResponse
+	once     sync.Once
+}
+
+type pushResponse struct {
+	status int
+	body   string
+}
+
+func newPushMessage(request context.Context, envelope pushEnvelope) *pushMessage {
+	return &pushMessage{request: request, envelope: envelope, response: make(chan pushResponse, 1)}
+}
+
+func (m *pushMessage) ID() string                    { return m.envelope.Message.ID }
+func (m *pushMessage) Data() []byte                  { return m.envelope.Message.Data }
+func (m *pushMessage) Attributes() map[string]string { return m.envelope.Message.Attributes }
+func (m *pushMessage) OrderingKey() string           { return m.envelope.Message.OrderingKey }
+func (m *pushMessage) DeliveryAttempt() *int         { return m.envelope.DeliveryAttempt }
+func (m *pushMessage) Ack()                          { m.respond(http.StatusNoContent, "") }
+func (m *pushMessage) Nack() {
+	m.respond(http.StatusServiceUnavailable, "message not processed - retry")
+}
+func (m *pushMessage) reject(reason string) { m.respond(http.StatusUnprocessableEntity, reason) }
+
+func (m *pushMessage) respond(status int, body string) {
+	m.once.Do(func() {
+		m.response <- pushResponse{status: status, body: body}
+	})
+}
+
+// PushSource receives the messages pushed to the worker for one subscription
+type PushSource struct {
+	messages chan *pushMessage
+}
+
+func newPushSource() *PushSource {
+	return &PushSource{messages: make(chan *pushMessage)}
+}
+
+// Receive handles each pushed message as its request arrives, as Pub/Sub limits how many it
+// pushes at once. Pub/Sub drops a request that outlasts the subscription's ack deadline and pushes
+// the message again, so processing stops when its request ends
+func (ps *PushSource) Receive(ctx context.Context, handle func(context.Context, Message)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-ps.messages:
+			go func() {
+				mctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				stop := context.AfterFunc(msg.request, cancel)
+				defer stop()
+				handle(mctx, msg)
+			}()
+		}
+	}
+}
+
+// PushHandler serves the requests from Pub/Sub push subscriptions, so the worker can run where it
+// is only woken by HTTP requests. Pub/Sub retries anything but a 2xx, so a message is acked with
+// 204, nacked with 503, and one that can never be processed is rejected with 422 when there's no
+// dead letter topic to hand it to
+type PushHandler struct {
+	sources        map[string]*PushSource
+	audience       string
+	serviceAccount string
+}
+
+// newPushHandler routes each envelope to the source for its subscription
+func newPushHandler(sources map[string]*PushSource, config *Config) *PushHandler {
+	if config.PushAudience == "" {
+		logger.Warn("no push audience configured - push requests will not be authenticated")
+	}
+	return &PushHandler{
+		sources:        sources,
+		audience:       config.PushAudience,
+		serviceAccount: config.PushServiceAccount,
+	}
+}
+
+func (ph *PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if status, err := ph.verify(r); err != nil {
+		logger.Warn("rejecting push request", zap.Error(err))
+		http.Error(w, err.Error(), status)
+		return
+	}
+	var envelope pushEnvelope
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushEnvelopeBytes)).Decode(&envelope); err != nil {
+		logger.Warn("unable to parse push envelope", zap.Error(err))
+		http.Error(w, "unable to parse push envelope: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, ok := ph.source(envelope.Subscription)
+	if !ok {
+		logger.Warn("push from unknown subscription", zap.String("subscription", envelope.Subscription))
+		http.Error(w, "unknown subscription "+envelope.Subscription, http.StatusNotFound)
+		return
+	}
+	msg := newPushMessage(r.Context(), envelope)
+	select {
+	case source.messages <- msg:
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case response := <-msg.response:
+		if response.status == http.StatusNoContent {
+			w.WriteHeader(response.status)
+			return
+		}
+		http.Error(w, response.body, response.status)
+	case <-r.Context().Done():
+		logger.Warn("push request ended before message was processed", zap.String("messageId", msg.ID()))
+	}
+}
+
+// verify checks the OIDC token Pub/Sub signs push requests with, when an audience is configured
+func (ph *PushHandler) verify(r *http.Request) (int, error) {
+	if ph.audience == "" {
+		return 0, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return http.StatusUnauthorized, errors.New("missing bearer token")
+	}
+	payload, err := validateToken(r.Context(), token, ph.audience)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid token: %w", err)
+	}
+	if ph.serviceAccount != "" && payload.Claims["email"] != ph.serviceAccount {
+		return http.StatusForbidden, fmt.Errorf("token is not for service account %s", ph.serviceAccount)
+	}
+	return 0, nil
+}
+
+// source finds the source for a subscription, given as projects/<project>/subscriptions/<id>. An
+// envelope without a subscription, such as one posted by hand, goes to the only source if there's
+// just one
+func (ph *PushHandler) source(subscription string) (*PushSource, bool) {
+	if subscription == "" && len(ph.sources) == 1 {
+		for _, source := range ph.sources {
+			return source, true
+		}
+	}
+	source, ok := ph.sources[path.Base(subscription)]
+	return source, ok
+}
+
+// servePush serves the push endpoint until ctx is done or the server fails. Requests still being
+// processed at shutdown are cancelled along with ctx, so Pub/Sub pushes their messages again
+func servePush(ctx context.Context, addr string, handler *PushHandler) error {
+	mux := http.NewServeMux()
+	mux.Handle(pushPath, handler)
+	server := &http.Server{Addr: addr, Handler: mux}
+	stop := context.AfterFunc(ctx, func() {
+		server.Shutdown(context.Background())
+	})
+	defer stop()
+	logger.Info("serving push subscriptions", zap.String("addr", addr), zap.String("path", pushPath))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func pushRequest(t *testing.T, subscription string, attributes map[string]string) *http.Request {
+	envelope := map[string]any{
+		"message": map[string]any{
+			"messageId":  "1",
+			"data":       []byte(line),
+			"attributes": attributes,
+		},
+		"subscription":    subscription,
+		"deliveryAttempt": 1,
+	}
+	body, err := json.Marshal(envelope)
+	assert.Nil(t, err)
+	return httptest.NewRequest(http.MethodPost, pushPath, strings.NewReader(string(body)))
+}
+
+func testPushHandler(t *testing.T, client *pubsub.Client, config *Config) *PushHandler {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(t, err)
+	source := newPushSource()
+	go worker.receive(ctx, client, source)
+	return newPushHandler(map[string]*PushSource{config.SubscriptionID: source}, config)
+}
+
+func downstreamServer(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("{\"id\":\"1111\"}"))
+	}))
+}
+
+func TestPushProcessesEnvelope(t *testing.T) {
+	sampleServer := downstreamServer(http.StatusCreated)
+	defer sampleServer.Close()
+	partyServer := downstreamServer(http.StatusCreated)
+	defer partyServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	handler := testPushHandler(t, nil, config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, pushRequest(t, "projects/rm-ras-sandbox/subscriptions/sample-file", map[string]string{"sample_summary_id": "test"}))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// an envelope posted by hand needn't name the subscription when there's only one
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, pushRequest(t, "", map[string]string{"sample_summary_id": "test"}))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestPushDownstreamFailureRetried(t *testing.T) {
+	sampleServer := downstreamServer(http.StatusInternalServerError)
+	defer sampleServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	handler := testPushHandler(t, nil, config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, pushRequest(t, "", map[string]string{"sample_summary_id": "test"}))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestPushRejectedWithoutDeadLetterTopic(t *testing.T) {
+	handler := testPushHandler(t, nil, testConfig())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, pushRequest(t, "", map[string]string{}))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "missing sample summary id")
+}
+
+func TestPushDeadLettered(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	deadLetterTopic, err := client.CreateTopic(ctx, "sample-file-dlq")
+	assert.Nil(err)
+	defer deadLetterTopic.Delete(ctx)
+
+	config := testConfig()
+	config.DeadLetterTopic = "sample-file-dlq"
+	handler := testPushHandler(t, client, config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, pushRequest(t, "", map[string]string{"sample_summary_id": "test", schemaVersionAttribute: "99"}))
+	assert.Equal(http.StatusNoContent, w.Code)
+
+	messages := srv.Messages()
+	assert.Equal(1, len(messages))
+	assert.Equal(line, string(messages[0].Data))
+	assert.Equal("unknown schema version \"99\"", messages[0].Attributes[deadLetterReasonAttribute])
+	assert.Equal("1", messages[0].Attributes[deadLetterMessageIdAttribute])
+}
+
+func TestPushRequestEndedCancelsProcessing(t *testing.T) {
+	sampleServer, cancelled := blockingServer()
+	defer sampleServer.Close()
+	config := testConfig()
+	config.SampleService.BaseURL = sampleServer.URL
+	handler := testPushHandler(t, nil, config)
+
+	// as when Pub/Sub stops waiting at the subscription's ack deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, pushRequest(t, "", map[string]string{"sample_summary_id": "test"}).WithContext(ctx))
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sample service request was not cancelled")
+	}
+}
+
+func TestServePushStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- servePush(ctx, "127.0.0.1:0", testPushHandler(t, nil, testConfig()))
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("push server did not stop")
+	}
+}
+
+func TestPushInvalidRequests(t *testing.T) {
+	handler := testPushHandler(t, nil, testConfig())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pushPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, pushPath, strings.NewReader("{\"message\":")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, pushRequest(t, "projects/rm-ras-sandbox/subscriptions/other", map[string]string{"sample_summary_id": "test"}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPushTokenVerified(t *testing.T) {
+	defer func(validate func(context.Context, string, string) (*idtoken.Payload, error)) {
+		validateToken = validate
+	}(validateToken)
+	validateToken = func(ctx context.Context, token string, audience string) (*idtoken.Payload, error) {
+		if token != "valid" || audience != "https://worker.example.com/push" {
+			return nil, errors.New("token rejected")
+		}
+		return &idtoken.Payload{Claims: map[string]any{"email": "pusher@rm-ras-sandbox.iam.gserviceaccount.com"}}, nil
+	}
+	config := testConfig()
+	config.PushAudience = "https://worker.example.com/push"
+	config.PushServiceAccount = "pusher@rm-ras-sandbox.iam.gserviceaccount.com"
+	handler := testPushHandler(t, nil, config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, pushRequest(t, "", map[string]string{}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r := pushRequest(t, "", map[string]string{})
+	r.Header.Set("Authorization", "Bearer invalid")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	handler.serviceAccount = "someone-else@rm-ras-sandbox.iam.gserviceaccount.com"
+	r = pushRequest(t, "", map[string]string{})
+	r.Header.Set("Authorization", "Bearer valid")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// once verified the message is processed, and rejected here as it has no sample summary id
+	handler.serviceAccount = config.PushServiceAccount
+	r = pushRequest(t, "", map[string]string{})
+	r.Header.Set("Authorization", "Bearer valid")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// birthDateLayout is how a birth date is sent to the sample and party services, whatever format
+// it arrived in
+const birthDateLayout = "02/01/2006"
+
+// how an empty number or date is sent to a downstream service
+const (
+	emptyFieldsNull = "null"
+	emptyFieldsOmit = "omit"
+)
+
+// SIC is a five digit standard industrial classification code, under either SIC92 or SIC2007
+type SIC string
+
+// Record is the typed form of a row. Values are parsed once here so the sample and party are
+// rendered from the same values, rather than each converting the columns in its own way. A nil
+// number or date means the column was empty
+type Record struct {
+	SAMPLEUNITREF string
+	CHECKLETTER   string
+	FROSIC92      SIC
+	RUSIC92       SIC
+	FROSIC2007    SIC
+	RUSIC2007     SIC
+	FROEMPMENT    *int
+	FROTOVER      *int
+	ENTREF        string
+	LEGALSTATUS   string
+	ENTREPMKR     string
+	REGION        string
+	BIRTHDATE     *time.Time
+	ENTNAME1      string
+	ENTNAME2      string
+	ENTNAME3      string
+	RUNAME1       string
+	RUNAME2       string
+	RUNAME3       string
+	TRADSTYLE1    string
+	TRADSTYLE2    string
+	TRADSTYLE3    string
+	SELTYPE       string
+	INCLEXCL      string
+	CELLNO        *int
+	FORMTYPE      string
+	CURRENCY      string
+
+	// Derived are the party attributes computed from the row by the derived field rules
+	Derived map[string]string
+}
+
+// newRecord parses the typed columns of a row, reporting every column that can't be parsed so
+// the line can be fixed in one go
+func newRecord(row Row, dateFormat string) (*Record, error) {
+	p := &recordParser{row: row, dateFormat: dateFormat}
+	record := &Record{
+		SAMPLEUNITREF: row["SAMPLEUNITREF"],
+		CHECKLETTER:   row["CHECKLETTER"],
+		FROSIC92:      p.sic("FROSIC92"),
+		RUSIC92:       p.sic("RUSIC92"),
+		FROSIC2007:    p.sic("FROSIC2007"),
+		RUSIC2007:     p.sic("RUSIC2007"),
+		FROEMPMENT:    p.int("FROEMPMENT"),
+		FROTOVER:      p.int("FROTOVER"),
+		ENTREF:        row["ENTREF"],
+		LEGALSTATUS:   row["LEGALSTATUS"],
+		ENTREPMKR:     row["ENTREPMKR"],
+		REGION:        row["REGION"],
+		BIRTHDATE:     p.date("BIRTHDATE"),
+		ENTNAME1:      row["ENTNAME1"],
+		ENTNAME2:      row["ENTNAME2"],
+		ENTNAME3:      row["ENTNAME3"],
+		RUNAME1:       row["RUNAME1"],
+		RUNAME2:       row["RUNAME2"],
+		RUNAME3:       row["RUNAME3"],
+		TRADSTYLE1:    row["TRADSTYLE1"],
+		TRADSTYLE2:    row["TRADSTYLE2"],
+		TRADSTYLE3:    row["TRADSTYLE3"],
+		SELTYPE:       row["SELTYPE"],
+		INCLEXCL:      row["INCLEXCL"],
+		CELLNO:        p.int("CELLNO"),
+		FORMTYPE:      row["FORMTYPE"],
+		CURRENCY:      row["CURRENCY"],
+	}
+	if err := errors.Join(p.errs...); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+type recordParser struct {
+	row        Row
+	dateFormat string
+	errs       []error
+}
+
+func (p *recordParser) value(column string) string {
+	return strings.TrimSpace(p.row[column])
+}
+
+func (p *recordParser) int(column string) *int {
+	value := p.value(column)
+	if value == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s must be a whole number but was %q", column, value))
+		return nil
+	}
+	return &i
+}
+
+func (p *recordParser) date(column string) *time.Time {
+	value := p.value(column)
+	if value == "" {
+		return nil
+	}
+	date, err := time.Parse(p.dateFormat, value)
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s must be a date in the format %s but was %q", column, p.dateFormat, value))
+		return nil
+	}
+	return &date
+}
+
+func (p *recordParser) sic(column string) SIC {
+	value := p.value(column)
+	if value == "" {
+		return ""
+	}
+	// spreadsheets drop the leading zero of codes like 01110, which only ever leaves four digits, so
+	// those are padded back out
+	code := value
+	if len(code) == 4 {
+		code = "0" + code
+	}
+	if len(code) != 5 || strings.Trim(code, "0123456789") != "" {
+		p.errs = append(p.errs, fmt.Errorf("%s must be a five digit SIC code but was %q", column, value))
+		return ""
+	}
+	return SIC(code)
+}
+
+// Optional is a column that may be empty. An empty column is sent as null, so that an unknown
+// value can't be mistaken for zero, or left out of the payload altogether when the service is
+// configured to omit empty fields
+type Optional[T any] struct {
+	value *T
+	omit  bool
+}
+
+func (o Optional[T]) MarshalJSON() ([]byte, error) {
+	if o.value == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(*o.value)
+}
+
+// IsZero leaves an empty column out of fields tagged omitzero when it is to be omitted
+func (o Optional[T]) IsZero() bool {
+	return o.value == nil && o.omit
+}
+
+func optional[T any](value T) Optional[T] {
+	return Optional[T]{value: &value}
+}
+
+func optionalInt(i *int, omit bool) Optional[int] {
+	if i == nil {
+		return Optional[int]{omit: omit}
+	}
+	return optional(*i)
+}
+
+// optionalIntString renders a number for the sample service, which takes every value as a string
+func optionalIntString(i *int, omit bool) Optional[string] {
+	if i == nil {
+		return Optional[string]{omit: omit}
+	}
+	return optional(strconv.Itoa(*i))
+}
+
+func optionalDate(date *time.Time, omit bool) Optional[string] {
+	if date == nil {
+		return Optional[string]{omit: omit}
+	}
+	return optional(date.Format(birthDateLayout))
+}
+
+// validateDateFormat checks a date format is a Go reference time layout that can round trip a date
+func validateDateFormat(format string) error {
+	reference := time.Date(2006, time.January, 2, 0, 0, 0, 0, time.UTC)
+	parsed, err := time.Parse(format, reference.Format(format))
+	if err != nil || !parsed.Equal(reference) {
+		return fmt.Errorf("%q is not a date layout such as %s", format, birthDateLayout)
+	}
+	return nil
+}
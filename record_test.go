@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRecord(t *testing.T) {
+	assert := assert.New(t)
+	row := Row{
+		"SAMPLEUNITREF": "49900000001",
+		"FROSIC2007":    "45320",
+		"FROEMPMENT":    " 0012 ",
+		"FROTOVER":      "0",
+		"BIRTHDATE":     "01/09/1993",
+		"RUNAME1":       "ACME LTD",
+	}
+	record, err := newRecord(row, birthDateLayout)
+	assert.Nil(err)
+	assert.Equal(SIC("45320"), record.FROSIC2007)
+	assert.Equal(SIC(""), record.FROSIC92)
+	assert.Equal(12, *record.FROEMPMENT)
+	assert.Equal(0, *record.FROTOVER)
+	assert.Nil(record.CELLNO)
+	assert.Equal(time.Date(1993, time.September, 1, 0, 0, 0, 0, time.UTC), *record.BIRTHDATE)
+	assert.Equal("ACME LTD", record.RUNAME1)
+}
+
+func TestNewRecordInvalidColumns(t *testing.T) {
+	row := Row{"FROSIC92": "453201", "FROEMPMENT": "twelve", "CELLNO": "1.5", "BIRTHDATE": "1993-09-01"}
+	_, err := newRecord(row, birthDateLayout)
+	assert.EqualError(t, err, "FROSIC92 must be a five digit SIC code but was \"453201\"\n"+
+		"FROEMPMENT must be a whole number but was \"twelve\"\n"+
+		"BIRTHDATE must be a date in the format 02/01/2006 but was \"1993-09-01\"\n"+
+		"CELLNO must be a whole number but was \"1.5\"")
+}
+
+func TestNewRecordPadsShortSIC(t *testing.T) {
+	record, err := newRecord(Row{"FROSIC2007": "1110", "RUSIC2007": "45320"}, birthDateLayout)
+	assert.Nil(t, err)
+	assert.Equal(t, SIC("01110"), record.FROSIC2007)
+	assert.Equal(t, SIC("45320"), record.RUSIC2007)
+
+	// only a code missing its leading zero is padded
+	for _, value := range []string{"12", "110", "1a10"} {
+		_, err := newRecord(Row{"FROSIC2007": value}, birthDateLayout)
+		assert.EqualError(t, err, fmt.Sprintf("FROSIC2007 must be a five digit SIC code but was %q", value))
+	}
+}
+
+func TestNewRecordDateFormat(t *testing.T) {
+	record, err := newRecord(Row{"BIRTHDATE": "1993-09-01"}, "2006-01-02")
+	assert.Nil(t, err)
+	// dates are sent the same way whatever format they arrived in
+	assert.Equal(t, "01/09/1993", *optionalDate(record.BIRTHDATE, false).value)
+}
+
+// the sample and party services receive the same value for each column, in the type each expects
+func TestSampleAndPartyConsistent(t *testing.T) {
+	assert := assert.New(t)
+	record := testRecord(t, Row{"FROEMPMENT": "0012", "FROTOVER": "340", "CELLNO": "7", "BIRTHDATE": "01/09/1993", "RUSIC2007": "45320"})
+
+	sample, err := create(record, false).marshall()
+	assert.Nil(err)
+	party, err := newParty(record, "test", "1111", false).marshall()
+	assert.Nil(err)
+
+	var s map[string]interface{}
+	assert.Nil(json.Unmarshal(sample, &s))
+	var p struct {
+		Attributes map[string]interface{} `json:"attributes"`
+	}
+	assert.Nil(json.Unmarshal(party, &p))
+
+	assert.Equal("12", s["froempment"])
+	assert.Equal(float64(12), p.Attributes["froempment"])
+	assert.Equal("340", s["frotover"])
+	assert.Equal(float64(340), p.Attributes["frotover"])
+	assert.Equal("7", s["cellNo"])
+	assert.Equal(float64(7), p.Attributes["cellNo"])
+	assert.Equal("01/09/1993", s["birthdate"])
+	assert.Equal(s["birthdate"], p.Attributes["birthdate"])
+	assert.Equal("45320", s["rusic2007"])
+	assert.Equal(s["rusic2007"], p.Attributes["rusic2007"])
+}
+
+func TestValidateDateFormat(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(validateDateFormat(birthDateLayout))
+	assert.Nil(validateDateFormat("2006-01-02"))
+	assert.Nil(validateDateFormat("020106"))
+	assert.NotNil(validateDateFormat("dd/mm/yyyy"))
+	assert.NotNil(validateDateFormat("01/2006"))
+}
+
+func TestEmptyAndZeroDistinguished(t *testing.T) {
+	assert := assert.New(t)
+	zero := testRecord(t, Row{"FROEMPMENT": "0", "FROTOVER": "0", "CELLNO": "0"})
+	empty := testRecord(t, Row{})
+
+	party, err := newParty(zero, "test", "1111", false).marshall()
+	assert.Nil(err)
+	assert.Contains(string(party), "\"froempment\":0,\"frotover\":0,")
+	assert.Contains(string(party), "\"cellNo\":0,")
+	party, err = newParty(empty, "test", "1111", false).marshall()
+	assert.Nil(err)
+	assert.Contains(string(party), "\"froempment\":null,\"frotover\":null,")
+	assert.Contains(string(party), "\"cellNo\":null,")
+
+	sample, err := create(zero, false).marshall()
+	assert.Nil(err)
+	assert.Contains(string(sample), "\"froempment\":\"0\",\"frotover\":\"0\",")
+	assert.Contains(string(sample), "\"cellNo\":\"0\",")
+	sample, err = create(empty, false).marshall()
+	assert.Nil(err)
+	assert.Contains(string(sample), "\"froempment\":null,\"frotover\":null,")
+	assert.Contains(string(sample), "\"cellNo\":null,")
+}
+
+func TestEmptyFieldsOmitted(t *testing.T) {
+	assert := assert.New(t)
+	zero := testRecord(t, Row{"FROEMPMENT": "0", "FROTOVER": "0", "CELLNO": "0"})
+	empty := testRecord(t, Row{})
+
+	// zero is a value, so is still sent
+	party, err := newParty(zero, "test", "1111", true).marshall()
+	assert.Nil(err)
+	assert.Contains(string(party), "\"froempment\":0,\"frotover\":0,")
+	assert.Contains(string(party), "\"cellNo\":0,")
+	party, err = newParty(empty, "test", "1111", true).marshall()
+	assert.Nil(err)
+	for _, field := range []string{"froempment", "frotover", "cellNo", "birthdate"} {
+		assert.NotContains(string(party), "\""+field+"\"")
+	}
+
+	sample, err := create(zero, true).marshall()
+	assert.Nil(err)
+	assert.Contains(string(sample), "\"froempment\":\"0\",\"frotover\":\"0\",")
+	sample, err = create(empty, true).marshall()
+	assert.Nil(err)
+	for _, field := range []string{"froempment", "frotover", "cellNo", "birthdate"} {
+		assert.NotContains(string(sample), "\""+field+"\"")
+	}
+	// other empty columns are still sent
+	assert.Contains(string(sample), "\"runame1\":\"\"")
+}
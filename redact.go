@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const defaultRedactFields = "ENTNAME1,ENTNAME2,ENTNAME3,RUNAME1,RUNAME2,RUNAME3,TRADSTYLE1,TRADSTYLE2,TRADSTYLE3,NAME"
+
+// redactor is configured alongside the logger so that every log statement masks respondent
+// details the same way
+var redactor = newRedactor(splitList(defaultRedactFields))
+
+// Redactor masks configured fields before they are logged, by name in JSON payloads and by
+// column position in raw sample lines
+type Redactor struct {
+	fields map[string]bool
+}
+
+func configureRedaction(fields []string) {
+	redactor = newRedactor(fields)
+}
+
+func newRedactor(fields []string) *Redactor {
+	r := &Redactor{fields: map[string]bool{}}
+	for _, field := range fields {
+		r.fields[strings.ToUpper(field)] = true
+	}
+	return r
+}
+
+func (r *Redactor) masked(field string, value string) bool {
+	return r.fields[strings.ToUpper(field)] && value != ""
+}
+
+func (r *Redactor) row(row Row) map[string]string {
+	masked := make(map[string]string, len(row))
+	for column, value := range row {
+		if r.masked(column, value) {
+			masked[column] = redacted
+		} else {
+			masked[column] = value
+		}
+	}
+	return masked
+}
+
+// raw masks a line by the position of each column in the schema
+func (r *Redactor) raw(data []byte, schema *Schema) string {
+	if schema.Format == formatJSON {
+		return r.json(data)
+	}
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.Comma = schema.comma()
+	values, err := cr.Read()
+	if err != nil {
+		// if it can't be parsed we can't tell which parts are sensitive
+		return redacted
+	}
+	for i, column := range schema.Columns {
+		if i < len(values) && r.masked(schema.field(column), values[i]) {
+			values[i] = redacted
+		}
+	}
+	return strings.Join(values, schema.Delimiter)
+}
+
+func (r *Redactor) json(payload []byte) string {
+	if len(payload) == 0 {
+		return ""
+	}
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return redacted
+	}
+	masked, err := json.Marshal(r.value(value))
+	if err != nil {
+		return redacted
+	}
+	return string(masked)
+}
+
+func (r *Redactor) value(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			if r.fields[strings.ToUpper(key)] && nested != nil && nested != "" {
+				v[key] = redacted
+			} else {
+				v[key] = r.value(nested)
+			}
+		}
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = r.value(nested)
+		}
+	}
+	return value
+}
+
+func redactedRow(key string, row Row) zap.Field {
+	return zap.Any(key, redactor.row(row))
+}
+
+func redactedRaw(key string, data []byte, schema *Schema) zap.Field {
+	return zap.String(key, redactor.raw(data, schema))
+}
+
+func redactedJSON(key string, payload []byte) zap.Field {
+	return zap.String(key, redactor.json(payload))
+}
+
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
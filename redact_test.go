@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactRow(t *testing.T) {
+	assert := assert.New(t)
+	r := newRedactor([]string{"RUNAME1", "TRADSTYLE1"})
+	row, _ := readSampleLine([]byte(line), sampleSchemaV1)
+
+	masked := r.row(row)
+	assert.Equal("13110000001", masked["SAMPLEUNITREF"])
+	assert.Equal("WW", masked["REGION"])
+	assert.Equal(redacted, masked["RUNAME1"])
+	// empty values are left as they are so missing data is still visible
+	assert.Equal("", masked["TRADSTYLE1"])
+	// the original row is not modified
+	assert.Equal("OFFICE FOR NATIONAL STATISTICS", row["RUNAME1"])
+}
+
+func TestRedactionConfigured(t *testing.T) {
+	defer func(r *Redactor) { redactor = r }(redactor)
+	setDefaults()
+	config, err := loadConfig()
+	assert.Nil(t, err)
+	configureRedaction(config.RedactFields)
+
+	row, _ := readSampleLine([]byte(line), sampleSchemaV1)
+	assert.Equal(t, redacted, redactor.row(row)["RUNAME1"])
+	assert.Equal(t, "13110000001", redactor.row(row)["SAMPLEUNITREF"])
+}
+
+func TestRedactRaw(t *testing.T) {
+	assert := assert.New(t)
+	r := newRedactor([]string{"RUNAME1"})
+
+	assert.Equal("13110000001:::::::::::WW:::::[REDACTED]:::::::::0001:", r.raw([]byte(line), sampleSchemaV1))
+	assert.Equal(redacted, r.raw([]byte("\"unterminated"), sampleSchemaV1))
+}
+
+func TestRedactRawMappedColumn(t *testing.T) {
+	r := newRedactor([]string{"RUNAME1"})
+	schema := &Schema{Version: "2", Delimiter: "|", Columns: []string{"REF", "REPORTING_NAME"}, Mapping: map[string]string{"REPORTING_NAME": "RUNAME1"}}
+
+	assert.Equal(t, "111|[REDACTED]", r.raw([]byte("111|ACME LTD"), schema))
+}
+
+func TestRedactJSON(t *testing.T) {
+	assert := assert.New(t)
+	r := newRedactor([]string{"RUNAME1", "NAME"})
+
+	payload := []byte("{\"sampleUnitRef\":\"111\",\"attributes\":{\"runame1\":\"ACME LTD\",\"runame2\":\"\",\"name\":\"ACME\"}}")
+	assert.Equal("{\"attributes\":{\"name\":\"[REDACTED]\",\"runame1\":\"[REDACTED]\",\"runame2\":\"\"},\"sampleUnitRef\":\"111\"}", r.json(payload))
+	assert.Equal(redacted, r.json([]byte("not json")))
+	assert.Equal("", r.json(nil))
+}
+
+func TestRedactSampleMarshall(t *testing.T) {
+	assert := assert.New(t)
+	core, logs := observer.New(zapcore.DebugLevel)
+	previous := logger
+	logger = zap.New(core)
+	defer func() { logger = previous }()
+
+	s := createSample()
+	_, err := s.marshall()
+	assert.Nil(err)
+
+	payload := logs.FilterMessage("marshalled sample to json").All()[0].ContextMap()["payload"]
+	assert.Contains(payload, "\"runame1\":\"[REDACTED]\"")
+	assert.Contains(payload, "\"entname1\":\"[REDACTED]\"")
+	assert.Contains(payload, "\"tradstyle1\":\"[REDACTED]\"")
+	assert.NotContains(payload, "ru1")
+	assert.Contains(payload, "\"sampleUnitRef\":\"111\"")
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{"RUNAME1", "RUNAME2"}, splitList(" RUNAME1, ,RUNAME2 "))
+	assert.Nil(t, splitList(""))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/zap"
+)
+
+const (
+	partyCreated = "CREATED"
+	partyExists  = "EXISTS"
+)
+
+// Result is published once a sample unit and its party have been processed so that
+// upstream services can reconcile sample unit ids without querying the sample service
+type Result struct {
+	SAMPLEUNITREF   string `json:"sampleUnitRef"`
+	SAMPLESUMMARYID string `json:"sampleSummaryId"`
+	SAMPLEUNITID    string `json:"sampleUnitId"`
+	PARTYOUTCOME    string `json:"partyOutcome"`
+}
+
+type ResultPublisher struct {
+	topic   *pubsub.Topic
+	ordered bool
+}
+
+// newResultPublisher publishes results in order when the worker receives units in order, so that
+// a result is never seen ahead of an earlier unit of the same summary
+func newResultPublisher(client *pubsub.Client, topicId string, ordered bool) *ResultPublisher {
+	if topicId == "" {
+		logger.Info("no results topic configured - results will not be published")
+		return nil
+	}
+	logger.Info("publishing results to topic", zap.String("topicId", topicId), zap.Bool("ordered", ordered))
+	topic := client.Topic(topicId)
+	topic.EnableMessageOrdering = ordered
+	return &ResultPublisher{topic: topic, ordered: ordered}
+}
+
+func newResult(sampleUnitRef string, sampleSummaryId string, sampleUnitId string, partyOutcome string) Result {
+	return Result{
+		SAMPLEUNITREF:   sampleUnitRef,
+		SAMPLESUMMARYID: sampleSummaryId,
+		SAMPLEUNITID:    sampleUnitId,
+		PARTYOUTCOME:    partyOutcome,
+	}
+}
+
+// publish sends the result with the ordering key of the message it is the result of, when results
+// are published in order
+func (rp *ResultPublisher) publish(ctx context.Context, result Result, orderingKey string) error {
+	// a nil publisher means no results topic has been configured
+	if rp == nil {
+		return nil
+	}
+	// a topic without ordering enabled fails every publish that has an ordering key
+	if !rp.ordered {
+		orderingKey = ""
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("unable to marshall result to json", zap.Error(err))
+		return err
+	}
+	msg := &pubsub.Message{
+		Data: payload,
+		Attributes: map[string]string{
+			"sample_summary_id": result.SAMPLESUMMARYID,
+		},
+		OrderingKey: orderingKey,
+	}
+	id, err := rp.topic.Publish(ctx, msg).Get(ctx)
+	if err != nil {
+		logger.Error("error publishing result", zap.Error(err), zap.String("sampleUnitRef", result.SAMPLEUNITREF))
+		if orderingKey != "" {
+			// a failed publish pauses the ordering key, which would fail every later result for
+			// the summary. The message is nacked so this result is retried ahead of them
+			rp.topic.ResumePublish(orderingKey)
+		}
+		return err
+	}
+	logger.Debug("result published", zap.String("resultMessageId", id), zap.String("sampleUnitRef", result.SAMPLEUNITREF))
+	return nil
+}
+
+func (rp *ResultPublisher) stop() {
+	if rp == nil {
+		return
+	}
+	rp.topic.Stop()
+}
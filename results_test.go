@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestResultPublishedAfterProcessing(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	configureLogging(true)
+	config := testConfig()
+
+	topic, err := createTopic(client, ctx, assert)
+	defer topic.Delete(ctx)
+	sub := createSubscription(client, ctx, err, topic, assert)
+	defer sub.Delete(ctx)
+
+	resultsTopic, err := client.CreateTopic(ctx, "sample-results")
+	assert.Nil(err)
+	defer resultsTopic.Delete(ctx)
+
+	sampleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{\"id\":\"1111\"}"))
+	}))
+	defer sampleServer.Close()
+	partyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer partyServer.Close()
+
+	config.SampleService.BaseURL = sampleServer.URL
+	config.PartyService.BaseURL = partyServer.URL
+	config.ResultsTopic = "sample-results"
+
+	msg := &pubsub.Message{
+		Data: []byte(line),
+		Attributes: map[string]string{
+			"sample_summary_id": "test",
+		},
+	}
+	_, err = topic.Publish(ctx, msg).Get(ctx)
+	assert.Nil(err)
+
+	worker, err := newCSVWorker(ctx, config)
+	assert.Nil(err)
+	subscribeUntilCleanup(t, worker, client)
+
+	time.Sleep(1 * time.Second)
+
+	var result Result
+	for _, m := range srv.Messages() {
+		if m.Attributes["sample_summary_id"] == "test" && m.Acks == 0 {
+			err = json.Unmarshal(m.Data, &result)
+			assert.Nil(err)
+		}
+	}
+	assert.Equal(newResult("13110000001", "test", "1111", partyExists), result)
+}
+
+func TestUnorderedResultIgnoresOrderingKey(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	resultsTopic, err := client.CreateTopic(ctx, "sample-results")
+	assert.Nil(err)
+	defer resultsTopic.Delete(ctx)
+
+	// as for a message received with an ordering key while ORDERING_KEY is none
+	results := newResultPublisher(client, "sample-results", false)
+	defer results.stop()
+	err = results.publish(ctx, newResult("13110000001", "test", "1111", partyCreated), "test")
+	assert.Nil(err)
+
+	messages := srv.Messages()
+	assert.Equal(1, len(messages))
+	assert.Equal("", messages[0].OrderingKey)
+}
+
+func TestResultPublisherDisabled(t *testing.T) {
+	configureLogging(true)
+	assert := assert.New(t)
+
+	rp := newResultPublisher(nil, "", false)
+	assert.Nil(rp)
+	assert.Nil(rp.publish(context.Background(), newResult("111", "test", "1111", partyCreated), ""))
+	rp.stop()
+}
+
+func TestResultMarshall(t *testing.T) {
+	assert := assert.New(t)
+	payload, err := json.Marshal(newResult("111", "test", "1111", partyCreated))
+	assert.Nil(err)
+	assert.Equal("{\"sampleUnitRef\":\"111\","+
+		"\"sampleSummaryId\":\"test\","+
+		"\"sampleUnitId\":\"1111\","+
+		"\"partyOutcome\":\"CREATED\"}", string(payload))
+}
@@ -2,115 +2,114 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 
-	"cloud.google.com/go/pubsub"
 	"go.uber.org/zap"
-
-	"github.com/spf13/viper"
 )
 
+// sampleColumns are the columns of a sample line in the order they appear
+var sampleColumns = []string{
+	"SAMPLEUNITREF", "CHECKLETTER", "FROSIC92", "RUSIC92", "FROSIC2007", "RUSIC2007", "FROEMPMENT",
+	"FROTOVER", "ENTREF", "LEGALSTATUS", "ENTREPMKR", "REGION", "BIRTHDATE", "ENTNAME1", "ENTNAME2",
+	"ENTNAME3", "RUNAME1", "RUNAME2", "RUNAME3", "TRADSTYLE1", "TRADSTYLE2", "TRADSTYLE3", "SELTYPE",
+	"INCLEXCL", "CELLNO", "FORMTYPE", "CURRENCY",
+}
+
 type Sample struct {
-	SAMPLEUNITREF string `json:"sampleUnitRef"`
-	CHECKLETTER   string `json:"checkletter"`
-	FROSIC92      string `json:"frosic92"`
-	RUSIC92       string `json:"rusic92"`
-	FROSIC2007    string `json:"frosic2007"`
-	RUSIC2007     string `json:"rusic2007"`
-	FROEMPMENT    string `json:"froempment"`
-	FROTOVER      string `json:"frotover"`
-	ENTREF        string `json:"entref"`
-	LEGALSTATUS   string `json:"legalstatus"`
-	ENTREPMKR     string `json:"entrepmkr"`
-	REGION        string `json:"region"`
-	BIRTHDATE     string `json:"birthdate"`
-	ENTNAME1      string `json:"entname1"`
-	ENTNAME2      string `json:"entname2"`
-	ENTNAME3      string `json:"entname3"`
-	RUNAME1       string `json:"runame1"`
-	RUNAME2       string `json:"runame2"`
-	RUNAME3       string `json:"runame3"`
-	TRADSTYLE1    string `json:"tradstyle1"`
-	TRADSTYLE2    string `json:"tradstyle2"`
-	TRADSTYLE3    string `json:"tradstyle3"`
-	SELTYPE       string `json:"seltype"`
-	INCLEXCL      string `json:"inclexcl"`
-	CELLNO        string `json:"cellNo"`
-	FORMTYPE      string `json:"formType"`
-	CURRENCY      string `json:"currency"`
+	SAMPLEUNITREF string           `json:"sampleUnitRef"`
+	CHECKLETTER   string           `json:"checkletter"`
+	FROSIC92      string           `json:"frosic92"`
+	RUSIC92       string           `json:"rusic92"`
+	FROSIC2007    string           `json:"frosic2007"`
+	RUSIC2007     string           `json:"rusic2007"`
+	FROEMPMENT    Optional[string] `json:"froempment,omitzero"`
+	FROTOVER      Optional[string] `json:"frotover,omitzero"`
+	ENTREF        string           `json:"entref"`
+	LEGALSTATUS   string           `json:"legalstatus"`
+	ENTREPMKR     string           `json:"entrepmkr"`
+	REGION        string           `json:"region"`
+	BIRTHDATE     Optional[string] `json:"birthdate,omitzero"`
+	ENTNAME1      string           `json:"entname1"`
+	ENTNAME2      string           `json:"entname2"`
+	ENTNAME3      string           `json:"entname3"`
+	RUNAME1       string           `json:"runame1"`
+	RUNAME2       string           `json:"runame2"`
+	RUNAME3       string           `json:"runame3"`
+	TRADSTYLE1    string           `json:"tradstyle1"`
+	TRADSTYLE2    string           `json:"tradstyle2"`
+	TRADSTYLE3    string           `json:"tradstyle3"`
+	SELTYPE       string           `json:"seltype"`
+	INCLEXCL      string           `json:"inclexcl"`
+	CELLNO        Optional[string] `json:"cellNo,omitzero"`
+	FORMTYPE      string           `json:"formType"`
+	CURRENCY      string           `json:"currency"`
 
-	sampleSummaryId string          `json:"-"`
-	msg             *pubsub.Message `json:"-"`
+	sampleSummaryId string         `json:"-"`
+	messageId       string         `json:"-"`
+	service         *ServiceClient `json:"-"`
 }
 
-func processSample(line []string, sampleSummaryId string, msg *pubsub.Message) (string, error) {
+func processSample(ctx context.Context, service *ServiceClient, record *Record, sampleSummaryId string, messageId string) (string, error) {
 	logger.Debug("processing sample")
-	s := create(line)
-	if s == nil {
-		err := errors.New("sample is nil")
-		return "", err
-	}
+	s := create(record, service.omitEmpty())
 	s.sampleSummaryId = sampleSummaryId
-	s.msg = msg
-	return s.sendToSampleService()
+	s.messageId = messageId
+	s.service = service
+	return s.sendToSampleService(ctx)
 }
 
-func create(line []string) *Sample {
-	defer func() {
-		if err := recover(); err != nil {
-			logger.Error("panic in sample.go create function", zap.Any("error", err))
-		}
-	}()
+func create(record *Record, omitEmpty bool) *Sample {
 	sampleUnit := &Sample{
-		SAMPLEUNITREF: line[0],
-		CHECKLETTER:   line[1],
-		FROSIC92:      line[2],
-		RUSIC92:       line[3],
-		FROSIC2007:    line[4],
-		RUSIC2007:     line[5],
-		FROEMPMENT:    line[6],
-		FROTOVER:      line[7],
-		ENTREF:        line[8],
-		LEGALSTATUS:   line[9],
-		ENTREPMKR:     line[10],
-		REGION:        line[11],
-		BIRTHDATE:     line[12],
-		ENTNAME1:      line[13],
-		ENTNAME2:      line[14],
-		ENTNAME3:      line[15],
-		RUNAME1:       line[16],
-		RUNAME2:       line[17],
-		RUNAME3:       line[18],
-		TRADSTYLE1:    line[19],
-		TRADSTYLE2:    line[20],
-		TRADSTYLE3:    line[21],
-		SELTYPE:       line[22],
-		INCLEXCL:      line[23],
-		CELLNO:        line[24],
-		FORMTYPE:      line[25],
-		CURRENCY:      line[26],
+		SAMPLEUNITREF: record.SAMPLEUNITREF,
+		CHECKLETTER:   record.CHECKLETTER,
+		FROSIC92:      string(record.FROSIC92),
+		RUSIC92:       string(record.RUSIC92),
+		FROSIC2007:    string(record.FROSIC2007),
+		RUSIC2007:     string(record.RUSIC2007),
+		FROEMPMENT:    optionalIntString(record.FROEMPMENT, omitEmpty),
+		FROTOVER:      optionalIntString(record.FROTOVER, omitEmpty),
+		ENTREF:        record.ENTREF,
+		LEGALSTATUS:   record.LEGALSTATUS,
+		ENTREPMKR:     record.ENTREPMKR,
+		REGION:        record.REGION,
+		BIRTHDATE:     optionalDate(record.BIRTHDATE, omitEmpty),
+		ENTNAME1:      record.ENTNAME1,
+		ENTNAME2:      record.ENTNAME2,
+		ENTNAME3:      record.ENTNAME3,
+		RUNAME1:       record.RUNAME1,
+		RUNAME2:       record.RUNAME2,
+		RUNAME3:       record.RUNAME3,
+		TRADSTYLE1:    record.TRADSTYLE1,
+		TRADSTYLE2:    record.TRADSTYLE2,
+		TRADSTYLE3:    record.TRADSTYLE3,
+		SELTYPE:       record.SELTYPE,
+		INCLEXCL:      record.INCLEXCL,
+		CELLNO:        optionalIntString(record.CELLNO, omitEmpty),
+		FORMTYPE:      record.FORMTYPE,
+		CURRENCY:      record.CURRENCY,
 	}
 	logger.Debug("sample created", zap.String("SAMPLEUNITREF", sampleUnit.SAMPLEUNITREF))
 	return sampleUnit
 }
 
-func (s *Sample) sendToSampleService() (string, error) {
+func (s *Sample) sendToSampleService(ctx context.Context) (string, error) {
 	payload, err := s.marshall()
 	if err != nil {
 		return "", err
 	}
 	sampleServiceUrl := s.getSampleServiceUrl()
-	return s.sendHttpRequest(sampleServiceUrl, payload)
+	return s.sendHttpRequest(ctx, sampleServiceUrl, payload)
 }
 
 func (s Sample) marshall() ([]byte, error) {
 	//marshall to JSON and send to the sample service as a POST request
 	payload, err := json.Marshal(s)
-	logger.Debug("marshalled sample to json", zap.ByteString("payload", payload))
+	logger.Debug("marshalled sample to json", redactedJSON("payload", payload))
 	if err != nil {
 		logger.Error("unable to marshall sample to json", zap.Error(err))
 		return nil, err
@@ -119,15 +118,21 @@ func (s Sample) marshall() ([]byte, error) {
 }
 
 func (s Sample) getSampleServiceUrl() string {
-	sampleServiceBaseUrl := viper.GetString("SAMPLE_SERVICE_BASE_URL")
+	sampleServiceBaseUrl := s.service.baseUrl()
 	sampleServicePath := fmt.Sprintf("/samples/%s/sampleunits/", s.sampleSummaryId)
 	sampleServiceUrl := sampleServiceBaseUrl + sampleServicePath
 	logger.Info("using sample service url", zap.String("url", sampleServiceUrl))
 	return sampleServiceUrl
 }
 
-func (s Sample) sendHttpRequest(url string, payload []byte) (string, error) {
-	resp, err := http.Post(url, "application/json", bytes.NewReader(payload))
+func (s Sample) sendHttpRequest(ctx context.Context, url string, payload []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		logger.Error("error creating HTTP request", zap.Error(err))
+		return "", err
+	}
+	req.Header.Add("content-type", "application/json")
+	resp, err := s.service.do(req)
 	if err != nil {
 		logger.Error("error sending HTTP request", zap.Error(err))
 		return "", err
@@ -138,9 +143,9 @@ func (s Sample) sendHttpRequest(url string, payload []byte) (string, error) {
 		logger.Error("error reading HTTP response", zap.Error(err))
 		return "", err
 	}
-	logger.Debug("response received", zap.ByteString("body", body))
+	logger.Debug("response received", redactedJSON("body", body))
 	if resp.StatusCode == http.StatusCreated {
-		logger.Info("sample created", zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.msg.ID))
+		logger.Info("sample created", zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.messageId))
 		data := make(map[string]interface{})
 		err := json.Unmarshal(body, &data)
 		if err != nil {
@@ -149,31 +154,36 @@ func (s Sample) sendHttpRequest(url string, payload []byte) (string, error) {
 
 		sampleUnitId, ok := data["id"].(string)
 		if !ok {
-			logger.Error("missing sample unit id - attempting to retrieve", zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.msg.ID))
-			sampleUnitId, err = s.getSampleUnitID()
+			logger.Error("missing sample unit id - attempting to retrieve", zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.messageId))
+			sampleUnitId, err = s.getSampleUnitID(ctx)
 			if err != nil {
 				return "", err
 			}
 		}
 		return sampleUnitId, nil
 	} else if resp.StatusCode == http.StatusConflict {
-		logger.Warn("attempted to create duplicate sample unit", zap.Int("status code", resp.StatusCode), zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.msg.ID))
+		logger.Warn("attempted to create duplicate sample unit", zap.Int("status code", resp.StatusCode), zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.messageId))
 		// if this sample unit has already been created attempt to retrieve the sample unit id
-		return s.getSampleUnitID()
+		return s.getSampleUnitID(ctx)
 	} else {
-		logger.Error("sample not created status", zap.Int("status code", resp.StatusCode), zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.msg.ID))
+		logger.Error("sample not created status", zap.Int("status code", resp.StatusCode), zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.messageId))
 		return "", errors.New(fmt.Sprintf("sample not created - status code %d", resp.StatusCode))
 	}
 }
 
-func (s Sample) getSampleUnitID() (string, error) {
-	logger.Debug("attempting to retrieve sample unit", zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.msg.ID))
-	sampleServiceBaseUrl := viper.GetString("SAMPLE_SERVICE_BASE_URL")
+func (s Sample) getSampleUnitID(ctx context.Context) (string, error) {
+	logger.Debug("attempting to retrieve sample unit", zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.messageId))
+	sampleServiceBaseUrl := s.service.baseUrl()
 	sampleServiceGetPath := fmt.Sprintf("/samples/%s/sampleunits/%s", s.sampleSummaryId, s.SAMPLEUNITREF)
 	sampleServiceGetUrl := sampleServiceBaseUrl + sampleServiceGetPath
 	logger.Info("using sample service url", zap.String("url", sampleServiceGetUrl))
 
-	resp, err := http.Get(sampleServiceGetUrl)
+	req, err := http.NewRequestWithContext(ctx, "GET", sampleServiceGetUrl, nil)
+	if err != nil {
+		logger.Error("error creating HTTP request", zap.Error(err))
+		return "", err
+	}
+	resp, err := s.service.do(req)
 	if err != nil {
 		logger.Error("error sending HTTP request", zap.Error(err))
 		return "", err
@@ -191,9 +201,9 @@ func (s Sample) getSampleUnitID() (string, error) {
 			logger.Error("error decoding JSON response", zap.Error(err))
 		}
 		sampleUnitId, ok := data["id"].(string)
-		logger.Debug("retrieved sample unit id", zap.String("sampleUnitId", sampleUnitId), zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.msg.ID))
+		logger.Debug("retrieved sample unit id", zap.String("sampleUnitId", sampleUnitId), zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.messageId))
 		if !ok {
-			logger.Error("missing sample unit id", zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.msg.ID))
+			logger.Error("missing sample unit id", zap.String("sampleUnitRef", s.SAMPLEUNITREF), zap.String("messageId", s.messageId))
 			return "", errors.New("unable to find sample unit")
 		}
 		return sampleUnitId, nil
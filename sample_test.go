@@ -1,14 +1,13 @@
 package main
 
 import (
-	"cloud.google.com/go/pubsub"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,19 +21,12 @@ func TestSampleSuccess(t *testing.T) {
 	defer ts.Close()
 
 	fmt.Printf("Setting sample service base url %v", ts.URL)
-	viper.Set("SAMPLE_SERVICE_BASE_URL", ts.URL)
+	service := testServiceClient(ts.URL)
 
 	line := []byte("13110000001:::::::::::WW:::::OFFICE FOR NATIONAL STATISTICS:::::::::0001:")
 
-	msg := &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
-	sample, _ := readSampleLine(line)
-	_, err := processSample(sample, "test", msg)
+	sample, _ := readSampleLine(line, sampleSchemaV1)
+	_, err := processSample(context.Background(), service, testRecord(t, sample), "test", "1")
 	assert.Nil(err, "error should be nil")
 }
 
@@ -48,49 +40,29 @@ func TestSampleError(t *testing.T) {
 	defer ts.Close()
 
 	fmt.Printf("Setting sample service base url %v", ts.URL)
-	viper.Set("SAMPLE_SERVICE_BASE_URL", ts.URL)
+	service := testServiceClient(ts.URL)
 
 	line := []byte("13110000001:::::::::::WW:::::OFFICE FOR NATIONAL STATISTICS:::::::::0001:")
 
-	msg := &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
-
-	sample, _ := readSampleLine(line)
-	_, err := processSample(sample, "test", msg)
+	sample, _ := readSampleLine(line, sampleSchemaV1)
+	_, err := processSample(context.Background(), service, testRecord(t, sample), "test", "1")
 	assert.NotNil(t, err, "error should not be nil")
 }
 
 func TestSampleServerURL(t *testing.T) {
-	s := &Sample{}
-	s.msg = &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
+	s := &Sample{service: testServiceClient("http://localhost:8080")}
+	s.messageId = "1"
 
 	assert := assert.New(t)
-	// set env variables and check url is correct
-	viper.Set("SAMPLE_SERVICE_BASE_URL", "https://127.0.0.1")
+	// set base url and check url is correct
+	s.service = testServiceClient("https://127.0.0.1")
 	s.sampleSummaryId = "test"
 	assert.Equal("https://127.0.0.1/samples/test/sampleunits/", s.getSampleServiceUrl())
 }
 
 func TestSendHttpRequest(t *testing.T) {
-	s := &Sample{}
-	s.msg = &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
+	s := &Sample{service: testServiceClient("http://localhost:8080")}
+	s.messageId = "1"
 	assert := assert.New(t)
 	payload := []byte("TEST")
 
@@ -103,34 +75,22 @@ func TestSendHttpRequest(t *testing.T) {
 	}))
 	ts.Start()
 	defer ts.Close()
-	_, err := s.sendHttpRequest(ts.URL, payload)
+	_, err := s.sendHttpRequest(context.Background(), ts.URL, payload)
 	assert.Nil(err, "error should be nil")
 }
 
 func TestSendHttpRequestBadUrl(t *testing.T) {
-	s := &Sample{}
-	s.msg = &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
+	s := &Sample{service: testServiceClient("http://localhost:8080")}
+	s.messageId = "1"
 	assert := assert.New(t)
 	payload := []byte("TEST")
-	_, err := s.sendHttpRequest("http://localhost", payload)
+	_, err := s.sendHttpRequest(context.Background(), "http://localhost", payload)
 	assert.NotNil(err, "error should be nil")
 }
 
 func TestSendHttpRequestWrongStatus(t *testing.T) {
-	s := &Sample{}
-	s.msg = &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
+	s := &Sample{service: testServiceClient("http://localhost:8080")}
+	s.messageId = "1"
 	assert := assert.New(t)
 	payload := []byte("TEST")
 
@@ -143,7 +103,7 @@ func TestSendHttpRequestWrongStatus(t *testing.T) {
 	}))
 	ts.Start()
 	defer ts.Close()
-	_, err := s.sendHttpRequest(ts.URL, payload)
+	_, err := s.sendHttpRequest(context.Background(), ts.URL, payload)
 	assert.NotNil(err, "error should be nil")
 }
 
@@ -156,10 +116,10 @@ func TestSendSampleSuccess(t *testing.T) {
 	defer ts.Close()
 
 	fmt.Printf("Setting sample service base url %v\n", ts.URL)
-	viper.Set("SAMPLE_SERVICE_BASE_URL", ts.URL)
 
 	s := createSample()
-	_, err := s.sendToSampleService()
+	s.service = testServiceClient(ts.URL)
+	_, err := s.sendToSampleService(context.Background())
 	assert.Nil(err, "error should be nil")
 }
 
@@ -213,7 +173,7 @@ func TestMarshallEmptyStruct(t *testing.T) {
 }
 
 func TestGetSampleUnit(t *testing.T) {
-	configureLogging()
+	configureLogging(true)
 	assert := assert.New(t)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -223,16 +183,16 @@ func TestGetSampleUnit(t *testing.T) {
 	defer ts.Close()
 
 	fmt.Printf("Setting sample service base url %v\n", ts.URL)
-	viper.Set("SAMPLE_SERVICE_BASE_URL", ts.URL)
 
 	s := createSample()
-	id, err := s.getSampleUnitID()
+	s.service = testServiceClient(ts.URL)
+	id, err := s.getSampleUnitID(context.Background())
 	assert.Nil(err, "error should be nil")
 	assert.Equal("1111", id)
 }
 
 func TestGetSampleUnitErrorResponse(t *testing.T) {
-	configureLogging()
+	configureLogging(true)
 	assert := assert.New(t)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -241,17 +201,17 @@ func TestGetSampleUnitErrorResponse(t *testing.T) {
 	defer ts.Close()
 
 	fmt.Printf("Setting sample service base url %v\n", ts.URL)
-	viper.Set("SAMPLE_SERVICE_BASE_URL", ts.URL)
 
 	s := createSample()
-	_, err := s.getSampleUnitID()
+	s.service = testServiceClient(ts.URL)
+	_, err := s.getSampleUnitID(context.Background())
 	assert.NotNil(err, "error should be not nil")
 }
 
 func createSample() *Sample {
 	s := &Sample{}
-	s.BIRTHDATE = "010180"
-	s.CELLNO = "123"
+	s.BIRTHDATE = optional("010180")
+	s.CELLNO = optional("123")
 	s.CHECKLETTER = "W"
 	s.CURRENCY = "£"
 	s.ENTNAME1 = "name1"
@@ -260,10 +220,10 @@ func createSample() *Sample {
 	s.ENTREF = "ref"
 	s.ENTREPMKR = "mkr"
 	s.FORMTYPE = "0001"
-	s.FROEMPMENT = "010120"
+	s.FROEMPMENT = optional("010120")
 	s.FROSIC92 = "92"
 	s.FROSIC2007 = "2007"
-	s.FROTOVER = "over"
+	s.FROTOVER = optional("over")
 	s.INCLEXCL = "inc"
 	s.LEGALSTATUS = "stats"
 	s.REGION = "gb"
@@ -277,13 +237,8 @@ func createSample() *Sample {
 	s.TRADSTYLE1 = "trad1"
 	s.TRADSTYLE2 = "trad2"
 	s.TRADSTYLE3 = "trad3"
-	s.msg = &pubsub.Message{
-		Data: []byte(line),
-		Attributes: map[string]string{
-			"sample_summary_id": "test",
-		},
-		ID: "1",
-	}
+	s.service = testServiceClient("http://localhost:8080")
+	s.messageId = "1"
 	return s
 }
 
@@ -294,13 +249,13 @@ func createEmptySample() string {
 		"\"rusic92\":\"\"," +
 		"\"frosic2007\":\"\"," +
 		"\"rusic2007\":\"\"," +
-		"\"froempment\":\"\"," +
-		"\"frotover\":\"\"," +
+		"\"froempment\":null," +
+		"\"frotover\":null," +
 		"\"entref\":\"\"," +
 		"\"legalstatus\":\"\"," +
 		"\"entrepmkr\":\"\"," +
 		"\"region\":\"\"," +
-		"\"birthdate\":\"\"," +
+		"\"birthdate\":null," +
 		"\"entname1\":\"\"," +
 		"\"entname2\":\"\"," +
 		"\"entname3\":\"\"," +
@@ -312,7 +267,7 @@ func createEmptySample() string {
 		"\"tradstyle3\":\"\"," +
 		"\"seltype\":\"\"," +
 		"\"inclexcl\":\"\"," +
-		"\"cellNo\":\"\"," +
+		"\"cellNo\":null," +
 		"\"formType\":\"\"," +
 		"\"currency\":\"\"}"
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"unicode/utf8"
+)
+
+const schemaVersionAttribute = "schema_version"
+
+// sampleSchemaV1 is the original colon delimited sample line
+var sampleSchemaV1 = &Schema{
+	Version:   "1",
+	Format:    formatCSV,
+	Delimiter: ":",
+	Columns:   sampleColumns,
+}
+
+// Row is a parsed sample line keyed by column name, so that building the sample and party
+// doesn't depend on where a column appears in the line. Missing columns read as empty
+type Row map[string]string
+
+// Schema describes a version of the sample line format, selected by the schema_version attribute
+// of the message. Columns lists the columns in the order they appear in the line, and Mapping
+// renames a column to the field it populates where the names differ. The format and delimiter
+// can also be overridden per message by the format and delimiter attributes. CSV controls how
+// strictly a csv line is parsed, defaulting to the CSV_ options
+type Schema struct {
+	Version   string            `json:"version"`
+	Format    string            `json:"format"`
+	Delimiter string            `json:"delimiter"`
+	Columns   []string          `json:"columns"`
+	Mapping   map[string]string `json:"mapping"`
+	CSV       CSVOptions        `json:"csv"`
+}
+
+type Schemas struct {
+	versions       map[string]*Schema
+	defaultVersion string
+}
+
+// loadSchemas returns the built in schema along with any defined in the schemas file, so that a
+// new format can be supported by configuration ahead of upstream sending it. The csv options
+// apply to the built in schema and to any schema in the file that doesn't set its own
+func loadSchemas(file string, defaultVersion string, options CSVOptions) (*Schemas, error) {
+	v1 := *sampleSchemaV1
+	v1.CSV = options
+	if err := v1.validate(); err != nil {
+		return nil, err
+	}
+	schemas := &Schemas{
+		versions:       map[string]*Schema{v1.Version: &v1},
+		defaultVersion: defaultVersion,
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read schemas file: %w", err)
+		}
+		var defined []json.RawMessage
+		if err := json.Unmarshal(data, &defined); err != nil {
+			return nil, fmt.Errorf("unable to parse schemas file: %w", err)
+		}
+		for _, raw := range defined {
+			schema := &Schema{CSV: options}
+			if err := json.Unmarshal(raw, schema); err != nil {
+				return nil, fmt.Errorf("unable to parse schemas file: %w", err)
+			}
+			if err := schema.validate(); err != nil {
+				return nil, err
+			}
+			schemas.versions[schema.Version] = schema
+		}
+	}
+	if _, ok := schemas.versions[defaultVersion]; !ok {
+		return nil, fmt.Errorf("default schema version %q is not defined", defaultVersion)
+	}
+	return schemas, nil
+}
+
+// validate also normalises the format and delimiter, so a delimiter can be given by name
+func (s *Schema) validate() error {
+	if s.Version == "" {
+		return errors.New("schema version is required")
+	}
+	format, err := parseFormat(s.Format)
+	if err != nil {
+		return fmt.Errorf("schema %s: %w", s.Version, err)
+	}
+	s.Format = format
+	if s.Format == formatCSV {
+		delimiter, err := parseDelimiter(s.Delimiter)
+		if err != nil {
+			return fmt.Errorf("schema %s delimiter must be a single character or one of colon, comma, pipe or tab", s.Version)
+		}
+		s.Delimiter = delimiter
+		if len(s.Columns) == 0 {
+			return fmt.Errorf("schema %s has no columns", s.Version)
+		}
+		if err := s.CSV.validate(); err != nil {
+			return fmt.Errorf("schema %s csv %w", s.Version, err)
+		}
+	}
+	return nil
+}
+
+// lookup selects the schema for a message, using the default when no version is given. An
+// unknown version is an error as the message can't be processed until the worker knows about it
+func (s *Schemas) lookup(attributes map[string]string) (*Schema, error) {
+	version, ok := attributes[schemaVersionAttribute]
+	if !ok || version == "" {
+		version = s.defaultVersion
+	}
+	schema, ok := s.versions[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema version %q", version)
+	}
+	format, hasFormat := attributes[formatAttribute]
+	delimiter, hasDelimiter := attributes[delimiterAttribute]
+	if !hasFormat && !hasDelimiter {
+		return schema, nil
+	}
+	// copy the schema rather than changing it for every other message
+	override := *schema
+	if hasFormat {
+		override.Format = format
+	}
+	if hasDelimiter {
+		override.Delimiter = delimiter
+	}
+	if err := override.validate(); err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+func (s *Schema) comma() rune {
+	comma, _ := utf8.DecodeRuneInString(s.Delimiter)
+	return comma
+}
+
+// row maps the values of a line to their columns
+func (s *Schema) row(values []string) Row {
+	row := Row{}
+	for i, column := range s.Columns {
+		if i >= len(values) {
+			break
+		}
+		row[s.field(column)] = values[i]
+	}
+	return row
+}
+
+// field is the name of the field a column populates
+func (s *Schema) field(column string) string {
+	if field, ok := s.Mapping[column]; ok {
+		return field
+	}
+	return column
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSchemas(t *testing.T, schemas string) string {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+	assert.Nil(t, os.WriteFile(path, []byte(schemas), 0600))
+	return path
+}
+
+func TestLookupDefaultSchema(t *testing.T) {
+	assert := assert.New(t)
+	schemas, err := loadSchemas("", "1", CSVOptions{})
+	assert.Nil(err)
+
+	schema, err := schemas.lookup(map[string]string{})
+	assert.Nil(err)
+	assert.Equal(sampleSchemaV1, schema)
+
+	schema, err = schemas.lookup(map[string]string{schemaVersionAttribute: "1"})
+	assert.Nil(err)
+	assert.Equal(sampleSchemaV1, schema)
+}
+
+func TestLookupUnknownSchema(t *testing.T) {
+	schemas, err := loadSchemas("", "1", CSVOptions{})
+	assert.Nil(t, err)
+
+	_, err = schemas.lookup(map[string]string{schemaVersionAttribute: "99"})
+	assert.EqualError(t, err, "unknown schema version \"99\"")
+}
+
+func TestSchemaFromFile(t *testing.T) {
+	assert := assert.New(t)
+	file := writeSchemas(t, `[{
+		"version": "2",
+		"delimiter": "|",
+		"columns": ["SAMPLEUNITREF", "REPORTING_NAME", "FORMTYPE"],
+		"mapping": {"REPORTING_NAME": "RUNAME1"}
+	}]`)
+	schemas, err := loadSchemas(file, "1", CSVOptions{})
+	assert.Nil(err)
+
+	schema, err := schemas.lookup(map[string]string{schemaVersionAttribute: "2"})
+	assert.Nil(err)
+	row, err := readSampleLine([]byte("49900000001|ACME LTD|0002"), schema)
+	assert.Nil(err)
+	assert.Equal(Row{"SAMPLEUNITREF": "49900000001", "RUNAME1": "ACME LTD", "FORMTYPE": "0002"}, row)
+
+	s := create(testRecord(t, row), false)
+	assert.Equal("ACME LTD", s.RUNAME1)
+	assert.Equal("", s.CHECKLETTER)
+}
+
+func TestSchemaFileDefaultVersion(t *testing.T) {
+	file := writeSchemas(t, `[{"version": "2", "delimiter": ",", "columns": ["SAMPLEUNITREF"]}]`)
+	schemas, err := loadSchemas(file, "2", CSVOptions{})
+	assert.Nil(t, err)
+
+	schema, err := schemas.lookup(map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, "2", schema.Version)
+}
+
+func TestInvalidSchemas(t *testing.T) {
+	assert := assert.New(t)
+	_, err := loadSchemas("", "2", CSVOptions{})
+	assert.EqualError(err, "default schema version \"2\" is not defined")
+
+	_, err = loadSchemas(writeSchemas(t, `[{"version": "2", "delimiter": "::", "columns": ["SAMPLEUNITREF"]}]`), "1", CSVOptions{})
+	assert.ErrorContains(err, "schema 2 delimiter must be a single character")
+
+	_, err = loadSchemas(writeSchemas(t, `[{"version": "2", "delimiter": ":"}]`), "1", CSVOptions{})
+	assert.EqualError(err, "schema 2 has no columns")
+
+	_, err = loadSchemas(writeSchemas(t, `not json`), "1", CSVOptions{})
+	assert.ErrorContains(err, "unable to parse schemas file")
+
+	_, err = loadSchemas("/does/not/exist", "1", CSVOptions{})
+	assert.ErrorContains(err, "unable to read schemas file")
+}
+
+func TestShortLineLeavesColumnsEmpty(t *testing.T) {
+	assert := assert.New(t)
+	row, err := readSampleLine([]byte("13110000001:A"), sampleSchemaV1)
+	assert.Nil(err)
+	assert.Equal(Row{"SAMPLEUNITREF": "13110000001", "CHECKLETTER": "A"}, row)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Subscription is a subscription the worker consumes from, so that one deployment can serve
+// several surveys or environments. Settings that are left out use the worker's own configuration
+type Subscription struct {
+	ID                     string `json:"subscription"`
+	Topic                  string `json:"topic"`
+	DefaultSchemaVersion   string `json:"defaultSchemaVersion"`
+	SampleServiceBaseURL   string `json:"sampleServiceBaseUrl"`
+	PartyServiceBaseURL    string `json:"partyServiceBaseUrl"`
+	MaxOutstandingMessages int    `json:"maxOutstandingMessages"`
+	NumGoroutines          int    `json:"numGoroutines"`
+}
+
+// loadSubscriptions reads the subscriptions file, or returns just the PUBSUB_SUB_ID subscription
+// when there isn't one
+func loadSubscriptions(file string, subscriptionId string) ([]Subscription, error) {
+	if file == "" {
+		return []Subscription{{ID: subscriptionId}}, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read subscriptions file: %w", err)
+	}
+	var subscriptions []Subscription
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, fmt.Errorf("unable to parse subscriptions file: %w", err)
+	}
+	return subscriptions, nil
+}
+
+func validateSubscriptions(subscriptions []Subscription) error {
+	if len(subscriptions) == 0 {
+		return errors.New("at least one subscription is required")
+	}
+	var errs []error
+	seen := map[string]bool{}
+	for _, s := range subscriptions {
+		switch {
+		case s.ID == "":
+			errs = append(errs, errors.New("subscription id is required"))
+		case seen[s.ID]:
+			errs = append(errs, fmt.Errorf("subscription %s is listed more than once", s.ID))
+		}
+		seen[s.ID] = true
+		if s.MaxOutstandingMessages < 0 || s.NumGoroutines < 0 {
+			errs = append(errs, fmt.Errorf("subscription %s concurrency settings must not be negative", s.ID))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// forSubscription is the configuration of the worker for one of its subscriptions
+func (c *Config) forSubscription(s Subscription) *Config {
+	config := *c
+	config.SubscriptionID = s.ID
+	config.Subscriptions = []Subscription{s}
+	if s.Topic != "" {
+		config.Topic = s.Topic
+	}
+	if s.DefaultSchemaVersion != "" {
+		config.DefaultSchemaVersion = s.DefaultSchemaVersion
+	}
+	if s.SampleServiceBaseURL != "" {
+		config.SampleService.BaseURL = s.SampleServiceBaseURL
+	}
+	if s.PartyServiceBaseURL != "" {
+		config.PartyService.BaseURL = s.PartyServiceBaseURL
+	}
+	if s.MaxOutstandingMessages > 0 {
+		config.MaxOutstandingMessages = s.MaxOutstandingMessages
+	}
+	if s.NumGoroutines > 0 {
+		config.NumGoroutines = s.NumGoroutines
+	}
+	return &config
+}
+
+// newCSVWorkers creates a worker for each subscription. Subscriptions calling the same downstream
+// service share one client, so its rate limit applies to them all
+func newCSVWorkers(ctx context.Context, config *Config) ([]*CSVWorker, error) {
+	var workers []*CSVWorker
+	services := serviceClients{}
+	for _, s := range config.Subscriptions {
+		worker, err := newSharedCSVWorker(ctx, config.forSubscription(s), services)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %s: %w", s.ID, err)
+		}
+		workers = append(workers, worker)
+	}
+	return workers, nil
+}
+
+func (s Subscription) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("subscription", s.ID)
+	enc.AddString("topic", s.Topic)
+	enc.AddString("defaultSchemaVersion", s.DefaultSchemaVersion)
+	enc.AddString("sampleServiceBaseUrl", s.SampleServiceBaseURL)
+	enc.AddString("partyServiceBaseUrl", s.PartyServiceBaseURL)
+	enc.AddInt("maxOutstandingMessages", s.MaxOutstandingMessages)
+	enc.AddInt("numGoroutines", s.NumGoroutines)
+	return nil
+}
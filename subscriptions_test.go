@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestSingleSubscriptionByDefault(t *testing.T) {
+	subscriptions, err := loadSubscriptions("", "sample-file")
+	assert.Nil(t, err)
+	assert.Equal(t, []Subscription{{ID: "sample-file"}}, subscriptions)
+}
+
+func TestSubscriptionsFromFile(t *testing.T) {
+	assert := assert.New(t)
+	file := writeSchemas(t, `[
+		{"subscription": "sample-file-bres", "topic": "sample-file-bres", "maxOutstandingMessages": 10, "numGoroutines": 2},
+		{"subscription": "sample-file-mbs", "defaultSchemaVersion": "2", "partyServiceBaseUrl": "http://party-mbs:8080"}
+	]`)
+	subscriptions, err := loadSubscriptions(file, "sample-file")
+	assert.Nil(err)
+	assert.Len(subscriptions, 2)
+
+	config := testConfig()
+	config.Subscriptions = subscriptions
+	assert.Nil(config.validate())
+
+	bres := config.forSubscription(subscriptions[0])
+	assert.Equal("sample-file-bres", bres.SubscriptionID)
+	assert.Equal("sample-file-bres", bres.Topic)
+	assert.Equal(10, bres.MaxOutstandingMessages)
+	assert.Equal(2, bres.NumGoroutines)
+	assert.Equal("1", bres.DefaultSchemaVersion)
+	assert.Equal("http://localhost:8080", bres.PartyService.BaseURL)
+
+	mbs := config.forSubscription(subscriptions[1])
+	assert.Equal("2", mbs.DefaultSchemaVersion)
+	assert.Equal("http://party-mbs:8080", mbs.PartyService.BaseURL)
+	assert.Equal(1000, mbs.MaxOutstandingMessages)
+	assert.Equal("sample-file", mbs.Topic)
+	// the worker's own config is unchanged
+	assert.Equal("http://localhost:8080", config.PartyService.BaseURL)
+}
+
+func TestSubscriptionsValidation(t *testing.T) {
+	assert := assert.New(t)
+	config := testConfig()
+	config.Subscriptions = nil
+	assert.ErrorContains(config.validate(), "at least one subscription is required")
+
+	config.Subscriptions = []Subscription{{ID: "a"}, {ID: "a"}, {}, {ID: "b", NumGoroutines: -1}, {ID: "c", SampleServiceBaseURL: "sample:8080"}}
+	err := config.validate()
+	assert.ErrorContains(err, "subscription a is listed more than once")
+	assert.ErrorContains(err, "subscription id is required")
+	assert.ErrorContains(err, "subscription b concurrency settings must not be negative")
+	assert.ErrorContains(err, "c sampleServiceBaseUrl must be an absolute http or https url")
+
+	_, err = loadSubscriptions(writeSchemas(t, "{}"), "sample-file")
+	assert.ErrorContains(err, "unable to parse subscriptions file")
+}
+
+func TestMultipleSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, _ := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	defer conn.Close()
+	client, _ := pubsub.NewClient(ctx, "rm-ras-sandbox", option.WithGRPCConn(conn))
+	defer client.Close()
+
+	assert := assert.New(t)
+	var requests [2]atomic.Int32
+	var servers [2]*httptest.Server
+	for i := range servers {
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests[i].Add(1)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{\"id\":\"1111\"}"))
+		}))
+		defer servers[i].Close()
+	}
+
+	config := testConfig()
+	config.Subscriptions = nil
+	for i, id := range []string{"survey-a", "survey-b"} {
+		topic, err := client.CreateTopic(ctx, id)
+		assert.Nil(err)
+		defer topic.Delete(ctx)
+		sub, err := client.CreateSubscription(ctx, id, pubsub.SubscriptionConfig{Topic: topic})
+		assert.Nil(err)
+		defer sub.Delete(ctx)
+		_, err = topic.Publish(ctx, &pubsub.Message{Data: []byte(line), Attributes: map[string]string{"sample_summary_id": id}}).Get(ctx)
+		assert.Nil(err)
+		config.Subscriptions = append(config.Subscriptions, Subscription{
+			ID:                   id,
+			SampleServiceBaseURL: servers[i].URL,
+			PartyServiceBaseURL:  servers[i].URL,
+		})
+	}
+
+	workers, err := newCSVWorkers(ctx, config)
+	assert.Nil(err)
+	assert.Len(workers, 2)
+	for _, worker := range workers {
+		subscribeUntilCleanup(t, worker, client)
+	}
+
+	time.Sleep(1 * time.Second)
+
+	for _, m := range srv.Messages() {
+		assert.Equal(1, m.Acks)
+	}
+	// each subscription sent its sample and party to its own services
+	assert.Equal(int32(2), requests[0].Load())
+	assert.Equal(int32(2), requests[1].Load())
+}
+
+func TestSubscriptionsShareServiceClients(t *testing.T) {
+	assert := assert.New(t)
+	config := testConfig()
+	config.PartyService.RateLimit = 5
+	config.PartyService.RateBurst = 1
+	config.Subscriptions = []Subscription{
+		{ID: "survey-a"},
+		{ID: "survey-b"},
+		{ID: "survey-c", PartyServiceBaseURL: "http://party-c:8080"},
+	}
+
+	workers, err := newCSVWorkers(context.Background(), config)
+	assert.Nil(err)
+	assert.Len(workers, 3)
+	// one client and so one rate limit per service, however many subscriptions call it
+	assert.Same(workers[0].partyService, workers[1].partyService)
+	assert.Same(workers[0].partyService.limiter, workers[1].partyService.limiter)
+	assert.Same(workers[0].sampleService, workers[2].sampleService)
+	assert.NotSame(workers[0].partyService, workers[2].partyService)
+	// the sample and party services are never shared, even at the same url
+	assert.NotSame(workers[0].sampleService, workers[0].partyService)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig holds the settings for connecting to a downstream service over TLS, such as an
+// internal service with a private CA or one that requires a client certificate
+type TLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	MinVersion string
+	ServerName string
+}
+
+func (t TLSConfig) validate(prefix string) error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s_TLS_CERT_FILE and %s_TLS_KEY_FILE must be set together", prefix, prefix))
+	}
+	if _, ok := tlsVersions[t.MinVersion]; t.MinVersion != "" && !ok {
+		errs = append(errs, fmt.Errorf("%s_TLS_MIN_VERSION must be one of 1.0, 1.1, 1.2 or 1.3", prefix))
+	}
+	return errors.Join(errs...)
+}
+
+// build returns nil when nothing has been configured so that the default TLS settings are used
+func (t TLSConfig) build() (*tls.Config, error) {
+	if t == (TLSConfig{}) {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: tlsVersions[t.MinVersion],
+	}
+	if t.CAFile != "" {
+		ca, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
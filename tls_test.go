@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeServerCA writes the test server's certificate as a CA bundle so the client trusts it
+func writeServerCA(t *testing.T, ts *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	assert.Nil(t, os.WriteFile(path, ca, 0600))
+	return path
+}
+
+// writeClientCert creates a self signed client certificate, returning the paths to the
+// certificate and key along with the certificate so the server can trust it
+func writeClientCert(t *testing.T) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "csv-worker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile, cert
+}
+
+func tlsServiceClient(t *testing.T, baseUrl string, tlsConfig TLSConfig) (*ServiceClient, error) {
+	config := testConfig().SampleService
+	config.BaseURL = baseUrl
+	config.TLS = tlsConfig
+	return newServiceClient(context.Background(), config, nil)
+}
+
+func TestTLSWithCustomCA(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	service, err := tlsServiceClient(t, ts.URL, TLSConfig{CAFile: writeServerCA(t, ts), MinVersion: "1.2"})
+	assert.Nil(err)
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := service.do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestTLSUntrustedServer(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	service, err := tlsServiceClient(t, ts.URL, TLSConfig{})
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	_, err = service.do(req)
+	assert.NotNil(t, err)
+}
+
+func TestTLSServerNameOverride(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	ca := writeServerCA(t, ts)
+
+	// the httptest certificate is valid for example.com
+	service, err := tlsServiceClient(t, ts.URL, TLSConfig{CAFile: ca, ServerName: "example.com"})
+	assert.Nil(err)
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	_, err = service.do(req)
+	assert.Nil(err)
+
+	service, err = tlsServiceClient(t, ts.URL, TLSConfig{CAFile: ca, ServerName: "party.internal"})
+	assert.Nil(err)
+	req, _ = http.NewRequest("GET", ts.URL, nil)
+	_, err = service.do(req)
+	assert.NotNil(err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	assert := assert.New(t)
+	certFile, keyFile, clientCert := writeClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("csv-worker", r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+	ca := writeServerCA(t, ts)
+
+	service, err := tlsServiceClient(t, ts.URL, TLSConfig{CAFile: ca, CertFile: certFile, KeyFile: keyFile})
+	assert.Nil(err)
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := service.do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// without the client certificate the handshake is rejected
+	service, err = tlsServiceClient(t, ts.URL, TLSConfig{CAFile: ca})
+	assert.Nil(err)
+	req, _ = http.NewRequest("GET", ts.URL, nil)
+	_, err = service.do(req)
+	assert.NotNil(err)
+}
+
+func TestTLSMissingCAFile(t *testing.T) {
+	_, err := TLSConfig{CAFile: "/does/not/exist"}.build()
+	assert.ErrorContains(t, err, "unable to read CA file")
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(TLSConfig{}.validate("PARTY_SERVICE"))
+	err := TLSConfig{CertFile: "client.pem", MinVersion: "2.0"}.validate("PARTY_SERVICE")
+	assert.ErrorContains(err, "PARTY_SERVICE_TLS_CERT_FILE and PARTY_SERVICE_TLS_KEY_FILE must be set together")
+	assert.ErrorContains(err, "PARTY_SERVICE_TLS_MIN_VERSION must be one of")
+}
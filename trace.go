@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// traceParentAttributes are the message attributes a publisher may put the W3C trace context of a
+// message in, the first being where the Pub/Sub client libraries put it when tracing is enabled
+var traceParentAttributes = []string{"googclient_traceparent", "traceparent"}
+
+type traceParentKey struct{}
+
+// withTraceParent carries the trace context of a message, if it has one, to the downstream
+// requests made while processing it
+func withTraceParent(ctx context.Context, msg Message) context.Context {
+	for _, attribute := range traceParentAttributes {
+		if traceParent := msg.Attributes()[attribute]; traceParent != "" {
+			return context.WithValue(ctx, traceParentKey{}, traceParent)
+		}
+	}
+	return ctx
+}
+
+// setTraceParent adds the trace context carried by the request's context, so the downstream
+// service's spans join the trace the message was published in
+func setTraceParent(req *http.Request) {
+	if traceParent, ok := req.Context().Value(traceParentKey{}).(string); ok {
+		req.Header.Set("traceparent", traceParent)
+	}
+}
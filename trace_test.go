@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceParentSentDownstream(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("traceparent"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{\"id\":\"1111\"}"))
+	}))
+	defer server.Close()
+	service := testServiceClient(server.URL)
+	row, err := readSampleLine([]byte(line), sampleSchemaV1)
+	assert.Nil(t, err)
+
+	msg := newMemoryMessage("1", []byte(line), map[string]string{"googclient_traceparent": traceParent})
+	_, err = processSample(withTraceParent(context.Background(), msg), service, testRecord(t, row), "test", "1")
+	assert.Nil(t, err)
+
+	// a message published without tracing adds nothing
+	msg = newMemoryMessage("2", []byte(line), map[string]string{})
+	_, err = processSample(withTraceParent(context.Background(), msg), service, testRecord(t, row), "test", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{traceParent, ""}, received)
+}
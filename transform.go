@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	transformTrim    = "trim"
+	transformUpper   = "upper"
+	transformLower   = "lower"
+	transformPad     = "pad"
+	transformMap     = "map"
+	transformDefault = "default"
+)
+
+// Transform is a step in the chain of changes made to a column before the sample and party are
+// built from it. A pad transform left pads the value with zeros to Width, a map transform replaces
+// a value found in Values, such as a legacy region code, and a default transform gives an empty
+// column Value
+type Transform struct {
+	Transform string            `json:"transform"`
+	Width     int               `json:"width"`
+	Values    map[string]string `json:"values"`
+	Value     string            `json:"value"`
+}
+
+// Transforms are the chains of transforms to apply, keyed by column
+type Transforms map[string][]Transform
+
+func loadTransforms(file string) (Transforms, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read transforms file: %w", err)
+	}
+	var defined Transforms
+	if err := json.Unmarshal(data, &defined); err != nil {
+		return nil, fmt.Errorf("unable to parse transforms file: %w", err)
+	}
+	transforms := Transforms{}
+	for column, chain := range defined {
+		for _, t := range chain {
+			if err := t.validate(); err != nil {
+				return nil, fmt.Errorf("column %s: %w", column, err)
+			}
+		}
+		transforms[strings.ToUpper(column)] = chain
+	}
+	return transforms, nil
+}
+
+func (t Transform) validate() error {
+	switch t.Transform {
+	case transformTrim, transformUpper, transformLower, transformDefault:
+	case transformPad:
+		if t.Width <= 0 {
+			return fmt.Errorf("%s transform width must be greater than zero", t.Transform)
+		}
+	case transformMap:
+		if len(t.Values) == 0 {
+			return fmt.Errorf("%s transform has no values", t.Transform)
+		}
+	default:
+		return fmt.Errorf("unknown transform %q", t.Transform)
+	}
+	return nil
+}
+
+func (t Transform) apply(value string) string {
+	switch t.Transform {
+	case transformTrim:
+		return strings.TrimSpace(value)
+	case transformUpper:
+		return strings.ToUpper(value)
+	case transformLower:
+		return strings.ToLower(value)
+	case transformPad:
+		// an empty column is left empty rather than becoming all zeros
+		if value == "" || len(value) >= t.Width {
+			return value
+		}
+		return strings.Repeat("0", t.Width-len(value)) + value
+	case transformMap:
+		if mapped, ok := t.Values[value]; ok {
+			return mapped
+		}
+		return value
+	case transformDefault:
+		if value == "" {
+			return t.Value
+		}
+		return value
+	}
+	return value
+}
+
+// apply returns a copy of the row with each column's transforms applied in order
+func (ts Transforms) apply(row Row) Row {
+	if len(ts) == 0 {
+		return row
+	}
+	transformed := Row{}
+	for column, value := range row {
+		transformed[column] = value
+	}
+	for column, chain := range ts {
+		value := transformed[column]
+		for _, t := range chain {
+			value = t.apply(value)
+		}
+		transformed[column] = value
+	}
+	return transformed
+}
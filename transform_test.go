@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransforms(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("ACME LTD", Transform{Transform: transformTrim}.apply("  ACME LTD "))
+	assert.Equal("ACME LTD", Transform{Transform: transformUpper}.apply("Acme Ltd"))
+	assert.Equal("acme ltd", Transform{Transform: transformLower}.apply("Acme Ltd"))
+
+	pad := Transform{Transform: transformPad, Width: 5}
+	assert.Equal("04532", pad.apply("4532"))
+	assert.Equal("45320", pad.apply("45320"))
+	assert.Equal("", pad.apply(""))
+
+	region := Transform{Transform: transformMap, Values: map[string]string{"YY": "WW"}}
+	assert.Equal("WW", region.apply("YY"))
+	assert.Equal("AA", region.apply("AA"))
+
+	currency := Transform{Transform: transformDefault, Value: "S"}
+	assert.Equal("S", currency.apply(""))
+	assert.Equal("E", currency.apply("E"))
+}
+
+func TestTransformsFromFile(t *testing.T) {
+	assert := assert.New(t)
+	file := writeSchemas(t, `{
+		"frosic92": [{"transform": "trim"}, {"transform": "pad", "width": 5}],
+		"REGION": [{"transform": "upper"}, {"transform": "map", "values": {"YY": "WW"}}],
+		"CURRENCY": [{"transform": "default", "value": "S"}]
+	}`)
+	transforms, err := loadTransforms(file)
+	assert.Nil(err)
+
+	row := Row{"FROSIC92": " 4532 ", "REGION": "yy", "RUNAME1": " ACME "}
+	transformed := transforms.apply(row)
+	assert.Equal(Row{"FROSIC92": "04532", "REGION": "WW", "CURRENCY": "S", "RUNAME1": " ACME "}, transformed)
+	// the original row is not modified
+	assert.Equal(" 4532 ", row["FROSIC92"])
+
+	record := testRecord(t, transformed)
+	assert.Equal(SIC("04532"), record.FROSIC92)
+}
+
+func TestNoTransforms(t *testing.T) {
+	transforms, err := loadTransforms("")
+	assert.Nil(t, err)
+	row := Row{"REGION": "yy"}
+	assert.Equal(t, row, transforms.apply(row))
+}
+
+func TestInvalidTransforms(t *testing.T) {
+	for transforms, expected := range map[string]string{
+		`{"REGION": [{"transform": "reverse"}]}`: "column REGION: unknown transform \"reverse\"",
+		`{"FROSIC92": [{"transform": "pad"}]}`:   "column FROSIC92: pad transform width must be greater than zero",
+		`{"REGION": [{"transform": "map"}]}`:     "column REGION: map transform has no values",
+	} {
+		_, err := loadTransforms(writeSchemas(t, transforms))
+		assert.EqualError(t, err, expected)
+	}
+	_, err := loadTransforms(writeSchemas(t, "[]"))
+	assert.ErrorContains(t, err, "unable to parse transforms file")
+}